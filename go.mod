@@ -1,3 +1,11 @@
 module github.com/chamzzzzzz/gitlab-repo-mirror
 
-go 1.20
+go 1.22
+
+require (
+	golang.org/x/term v0.19.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.19.0 // indirect
@@ -0,0 +1,97 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runAudit prints, per source, the repos that exist on the remote but are
+// not mirrored locally and the local mirrors that have no remote repo.
+// Nothing is cloned, updated or removed.
+func runAudit(config *Config) int {
+	code := ExitOK
+	for _, source := range config.Sources {
+		repos, _, err := getRepo(context.Background(), config, source)
+		if err != nil {
+			warnf("Failed to get source [%s] repos. error:'%s'", source, err)
+			code = ExitFailed
+			continue
+		}
+		expected := map[string]bool{}
+		wikis := map[string]bool{}
+		var missing []string
+		for _, repo := range repos {
+			local := localPath(config, source, repo)
+			expected[local] = true
+			wikis[wikiPath(local)] = true
+			if skip(source, repo) {
+				continue
+			}
+			if _, err := os.Stat(local); os.IsNotExist(err) {
+				missing = append(missing, local)
+			}
+		}
+		mirrors, err := localMirrors(config, source)
+		if err != nil {
+			warnf("Failed to walk mirrors of source [%s]: %s", source, err)
+			code = ExitFailed
+			continue
+		}
+		var orphans []string
+		for _, local := range mirrors {
+			if !expected[local] && !wikis[local] {
+				orphans = append(orphans, local)
+			}
+		}
+		sort.Strings(missing)
+		sort.Strings(orphans)
+		fmt.Printf("Source [%s]: %d remote repos, %d local mirrors, %d not mirrored, %d orphaned\n", source, len(repos), len(mirrors), len(missing), len(orphans))
+		for _, local := range missing {
+			fmt.Printf("  missing %s\n", local)
+		}
+		for _, local := range orphans {
+			fmt.Printf("  orphan  %s\n", local)
+		}
+	}
+	return code
+}
+
+// localMirrors returns every mirror directory found under the source's
+// layout root in each destination its repos may be kept in, never in the
+// destinations of other sources.
+func localMirrors(config *Config, source *Source) ([]string, error) {
+	var mirrors []string
+	seen := map[string]bool{}
+	for _, dir := range source.destinations(config) {
+		root := filepath.Join(dir, layoutRoot(source))
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(d.Name(), ".git") || gitdir(path) != path {
+				mirrors = append(mirrors, path)
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mirrors, nil
+}
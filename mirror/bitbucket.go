@@ -0,0 +1,222 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// bitbucket lists repos of Bitbucket Cloud, when Domain is bitbucket.org,
+// or of a Bitbucket Server / Data Center instance otherwise. Org limits
+// Cloud to one workspace and Server to one project key. With a Username the
+// Token is sent as an app password, otherwise as a bearer access token.
+type bitbucket struct{}
+
+// bitbucketLink is an entry of the clone links of a repo, named https or
+// http and ssh.
+type bitbucketLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type bitbucketCloudRepo struct {
+	Name        string    `json:"name"`
+	FullName    string    `json:"full_name"`
+	Slug        string    `json:"slug"`
+	Description string    `json:"description"`
+	IsPrivate   bool      `json:"is_private"`
+	Size        int64     `json:"size"`
+	CreatedOn   time.Time `json:"created_on"`
+	UpdatedOn   time.Time `json:"updated_on"`
+	MainBranch  struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+	Workspace struct {
+		Slug string `json:"slug"`
+	} `json:"workspace"`
+	Links struct {
+		Clone []bitbucketLink `json:"clone"`
+	} `json:"links"`
+}
+
+type bitbucketServerRepo struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+	Archived    bool   `json:"archived"`
+	Project     struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	} `json:"project"`
+	Links struct {
+		Clone []bitbucketLink `json:"clone"`
+	} `json:"links"`
+}
+
+// cloneLinks returns the http(s) and ssh clone URLs of links. Bitbucket
+// Cloud puts the requesting user into the https URL; it is removed so the
+// remote does not depend on who listed it.
+func cloneLinks(links []bitbucketLink) (http, ssh string) {
+	for _, link := range links {
+		switch link.Name {
+		case "https", "http":
+			http = link.Href
+			if u, err := neturl.Parse(link.Href); err == nil {
+				u.User = nil
+				http = u.String()
+			}
+		case "ssh":
+			ssh = link.Href
+		}
+	}
+	return
+}
+
+func (r *bitbucketCloudRepo) repo() *Repo {
+	repo := &Repo{
+		Name:              r.Name,
+		NameWithNamespace: r.FullName,
+		Path:              r.Slug,
+		PathWithNamespace: r.FullName,
+		CreatedAt:         r.CreatedOn,
+		LastActivityAt:    r.UpdatedOn,
+		Description:       r.Description,
+		DefaultBranch:     r.MainBranch.Name,
+		Visibility:        "public",
+	}
+	if r.IsPrivate {
+		repo.Visibility = "private"
+	}
+	repo.HTTPURLToRepo, repo.SSHURLToRepo = cloneLinks(r.Links.Clone)
+	repo.Statistics.RepositorySize = r.Size
+	repo.Namespace.FullPath = r.Workspace.Slug
+	return repo
+}
+
+func (r *bitbucketServerRepo) repo() *Repo {
+	namespace := strings.ToLower(r.Project.Key)
+	repo := &Repo{
+		ID:                r.ID,
+		Name:              r.Name,
+		NameWithNamespace: r.Project.Key + "/" + r.Name,
+		Path:              r.Slug,
+		PathWithNamespace: namespace + "/" + r.Slug,
+		Description:       r.Description,
+		Archived:          r.Archived,
+		Visibility:        "private",
+	}
+	if r.Public {
+		repo.Visibility = "public"
+	}
+	repo.HTTPURLToRepo, repo.SSHURLToRepo = cloneLinks(r.Links.Clone)
+	repo.Namespace.ID = r.Project.ID
+	repo.Namespace.FullPath = namespace
+	return repo
+}
+
+func (bitbucket) cloud(source *Source) bool {
+	return source.Domain == "bitbucket.org"
+}
+
+// api returns the API root, APIBaseURL if set.
+func (b bitbucket) api(source *Source) string {
+	if source.APIBaseURL != "" {
+		return strings.TrimRight(source.APIBaseURL, "/")
+	}
+	if b.cloud(source) {
+		return "https://api.bitbucket.org/2.0"
+	}
+	return source.baseURL() + "/rest/api/1.0"
+}
+
+func (b bitbucket) List(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	if b.cloud(source) {
+		return b.listCloud(ctx, config, source)
+	}
+	return b.listServer(ctx, config, source)
+}
+
+// listCloud follows the next URL of each page of the repositories listing.
+func (b bitbucket) listCloud(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	url := b.api(source) + "/repositories?role=member&pagelen=100"
+	if source.Org != "" {
+		url = fmt.Sprintf("%s/repositories/%s?pagelen=100", b.api(source), neturl.PathEscape(source.Org))
+	}
+	var repos []*Repo
+	total := 0
+	for page := 1; url != ""; page++ {
+		var p struct {
+			Size   int                   `json:"size"`
+			Next   string                `json:"next"`
+			Values []*bitbucketCloudRepo `json:"values"`
+		}
+		err := retry(ctx, config, fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, func() error {
+			resp, err := apiGet(ctx, source, url)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			err = checkStatus(source, resp)
+			if err != nil {
+				return err
+			}
+			return json.NewDecoder(resp.Body).Decode(&p)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if page == 1 {
+			total = p.Size
+		}
+		for _, r := range p.Values {
+			repos = append(repos, r.repo())
+		}
+		url = p.Next
+	}
+	return dedup(source, repos), total, nil
+}
+
+// listServer pages the repos listing by start offset until isLastPage.
+func (b bitbucket) listServer(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	base := b.api(source) + "/repos"
+	if source.Org != "" {
+		base = fmt.Sprintf("%s/projects/%s/repos", b.api(source), neturl.PathEscape(source.Org))
+	}
+	var repos []*Repo
+	for start, page := 0, 1; ; page++ {
+		var p struct {
+			IsLastPage    bool                   `json:"isLastPage"`
+			NextPageStart int                    `json:"nextPageStart"`
+			Values        []*bitbucketServerRepo `json:"values"`
+		}
+		url := fmt.Sprintf("%s?start=%d&limit=100", base, start)
+		err := retry(ctx, config, fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, func() error {
+			resp, err := apiGet(ctx, source, url)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			err = checkStatus(source, resp)
+			if err != nil {
+				return err
+			}
+			return json.NewDecoder(resp.Body).Decode(&p)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, r := range p.Values {
+			repos = append(repos, r.repo())
+		}
+		if p.IsLastPage || len(p.Values) == 0 || p.NextPageStart <= start {
+			break
+		}
+		start = p.NextPageStart
+	}
+	return dedup(source, repos), 0, nil
+}
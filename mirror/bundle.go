@@ -0,0 +1,141 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func (c *Config) bundleDir() string {
+	if c.BundleDir != "" {
+		return c.BundleDir
+	}
+	return filepath.Join(c.Destination, ".bundles")
+}
+
+func bundle(ctx context.Context, local, file string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, "-C", local, "bundle", "create", file, "--all")
+}
+
+// writeBundle exports the mirror at local as a single-file bundle under
+// Config.BundleDir, records its checksum in <BundleDir>/SHA256SUMS and
+// uploads it when Config.S3 is set. The bundle is only regenerated when the
+// mirror changed or the bundle is missing.
+func writeBundle(ctx context.Context, config *Config, source *Source, stat *Stat, repo *Repo, local string, changed bool, w io.Writer) {
+	name := filepath.ToSlash(filepath.Join(source.dir(), repo.PathWithNamespace+".bundle"))
+	file := filepath.Join(config.bundleDir(), filepath.FromSlash(name))
+	if !changed && bundled(config, file) {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err == nil {
+		bctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+		_, err = bundle(bctx, local, file+".tmp", w)
+		cancel()
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		stat.failf("Failed bundle [%s] -> [%s]: %s", local, file, err)
+		stat.FailedBundle++
+		return
+	}
+	infof("Bundled [%s] -> [%s]", local, file)
+	stat.Bundles++
+	sum, err := fileSum(file)
+	if err != nil {
+		stat.failf("Failed checksum [%s]: %s", file, err)
+		stat.FailedBundle++
+		return
+	}
+	err = recordSum(config.bundleDir(), name, sum)
+	if err != nil {
+		warnf("Failed to record checksum of [%s]: %s", file, err)
+	}
+	if config.S3 != nil {
+		uploadBundle(config.S3, stat, file, name, sum)
+	}
+}
+
+// sumsMu serializes the updates of SHA256SUMS by concurrent repos.
+var sumsMu sync.Mutex
+
+// recordSum sets the checksum of the bundle name, relative to dir, in
+// dir/SHA256SUMS, which keeps the "<hash>  <name>" lines of sha256sum
+// sorted by name so sha256sum -c run in dir verifies every bundle.
+func recordSum(dir, name, sum string) error {
+	sumsMu.Lock()
+	defer sumsMu.Unlock()
+	file := filepath.Join(dir, "SHA256SUMS")
+	sums := map[string]string{}
+	b, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		hash, n, ok := strings.Cut(scanner.Text(), "  ")
+		if ok {
+			sums[n] = hash
+		}
+	}
+	sums[name] = sum
+	names := make([]string, 0, len(sums))
+	for n := range sums {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	for _, n := range names {
+		fmt.Fprintf(&out, "%s  %s\n", sums[n], n)
+	}
+	return writeFileAtomic(file, out.Bytes())
+}
+
+// bundled reports whether the bundle at file is current: it exists and,
+// with S3 configured, was uploaded, in which case it may have been deleted
+// locally.
+func bundled(config *Config, file string) bool {
+	_, err := os.Stat(file)
+	if config.S3 == nil {
+		return err == nil
+	}
+	_, merr := os.Stat(file + ".uploaded")
+	return merr == nil && (err == nil || config.S3.DeleteLocal)
+}
+
+// uploadBundle uploads the bundle at file with checksum sum to S3 unless
+// its content is the same as the last upload, which is recorded by checksum
+// in file.uploaded.
+func uploadBundle(s3 *S3, stat *Stat, file, name, sum string) {
+	marker := file + ".uploaded"
+	uploaded, _ := os.ReadFile(marker)
+	if string(uploaded) != sum {
+		os.Remove(marker)
+		err := s3.upload(file, s3.key(name), sum)
+		if err != nil {
+			stat.failf("Failed upload [%s] -> [s3://%s/%s]: %s", file, s3.Bucket, s3.key(name), err)
+			stat.FailedUpload++
+			return
+		}
+		err = os.WriteFile(marker, []byte(sum), 0644)
+		if err != nil {
+			warnf("Failed to record upload of [%s]: %s", file, err)
+		}
+		infof("Uploaded [%s] -> [s3://%s/%s]", file, s3.Bucket, s3.key(name))
+		stat.Uploaded++
+	}
+	if s3.DeleteLocal {
+		os.Remove(file)
+	}
+}
@@ -0,0 +1,144 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// minGitVersion is the oldest git the tool is known to work with.
+var minGitVersion = [3]int{2, 20, 0}
+
+// runCheck verifies the environment a run needs without mirroring anything:
+// the config is valid, git and, if any source uses LFS, git lfs are
+// installed, every destination is writable and every source's API accepts
+// its token. It prints one PASS or FAIL line per check. invalid is the
+// error of Config.Validate, checked first.
+func runCheck(config *Config, invalid error) int {
+	code := ExitOK
+	report := func(what string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", what, strings.ReplaceAll(err.Error(), "\n", "; "))
+			code = ExitFailed
+			return
+		}
+		fmt.Printf("PASS  %s\n", what)
+	}
+
+	report("config is valid", invalid)
+	version, err := gitVersion()
+	what := "git installed"
+	if version != "" {
+		what = fmt.Sprintf("git %s installed", version)
+	}
+	report(fmt.Sprintf("%s (need %d.%d.%d or newer)", what, minGitVersion[0], minGitVersion[1], minGitVersion[2]), err)
+	for _, source := range config.Sources {
+		if source.LFS {
+			_, err := gitOutput(nil, "lfs", "version")
+			report("git lfs installed", err)
+			break
+		}
+	}
+	for _, dir := range destinations(config) {
+		report(fmt.Sprintf("destination [%s] is writable", dir), writable(dir))
+	}
+	for _, source := range config.Sources {
+		if len(source.ListCommand) > 0 {
+			_, err := exec.LookPath(source.ListCommand[0])
+			report(fmt.Sprintf("source [%s] list command found", source), err)
+			continue
+		}
+		report(fmt.Sprintf("source [%s] API reachable and token accepted", source), checkAPI(context.Background(), source))
+	}
+	return code
+}
+
+// gitVersion returns the installed git version and an error if it cannot
+// be run or is older than minGitVersion.
+func gitVersion() (string, error) {
+	out, err := gitOutput(nil, "version")
+	if err != nil {
+		return "", err
+	}
+	// git version 2.39.5, or 2.45.1.windows.1 and 2.39.3 (Apple Git-145).
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return "", fmt.Errorf("unexpected git version output '%s'", strings.TrimSpace(string(out)))
+	}
+	version := fields[2]
+	var v [3]int
+	for i, part := range strings.SplitN(version, ".", 4) {
+		if i == len(v) {
+			break
+		}
+		v[i], err = strconv.Atoi(part)
+		if err != nil {
+			return version, fmt.Errorf("unexpected git version '%s'", version)
+		}
+	}
+	for i := range v {
+		if v[i] != minGitVersion[i] {
+			if v[i] < minGitVersion[i] {
+				return version, fmt.Errorf("git %s is too old", version)
+			}
+			break
+		}
+	}
+	return version, nil
+}
+
+// writable creates dir if needed and writes and removes a file in it.
+func writable(dir string) error {
+	err := ensureDir(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkAPI makes a single API request that needs the source's token: the
+// current user when a token is set, or one repo of the listing otherwise.
+func checkAPI(ctx context.Context, source *Source) error {
+	var url string
+	switch source.kind() {
+	case "gitlab":
+		url = source.baseURL() + "/api/v4/projects?per_page=1"
+		if source.Token != "" {
+			url = source.baseURL() + "/api/v4/user"
+		}
+	case "github":
+		url = github{}.api(source) + "/rate_limit"
+		if source.Token != "" {
+			url = github{}.api(source) + "/user"
+		}
+	case "gitea":
+		url = source.baseURL() + "/api/v1/repos/search?limit=1"
+		if source.Token != "" {
+			url = source.baseURL() + "/api/v1/user"
+		}
+	case "bitbucket":
+		url = bitbucket{}.api(source) + "/repos?limit=1"
+		if (bitbucket{}).cloud(source) {
+			url = bitbucket{}.api(source) + "/user"
+		}
+	default:
+		return fmt.Errorf("unknown source type '%s'", source.Type)
+	}
+	resp, err := apiGet(ctx, source, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
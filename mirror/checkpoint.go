@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is the least time between two writes of the
+// checkpoint while repos complete.
+const checkpointInterval = 5 * time.Second
+
+// checkpoint records the repos each source completed during the current
+// run, so a run restarted with -resume skips them. It is written to
+// <Destination>/.checkpoint.json as repos complete and removed once a run
+// finishes without failures. A repo counts as still complete only while
+// its remote and last activity are the ones recorded.
+type checkpoint struct {
+	mu      sync.Mutex
+	file    string
+	saved   time.Time
+	Sources map[string]map[string]*checkpointRepo `json:"sources"`
+}
+
+type checkpointRepo struct {
+	Remote         string    `json:"remote"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+}
+
+func (c *Config) checkpointFile() string {
+	return filepath.Join(c.Destination, ".checkpoint.json")
+}
+
+// loadCheckpoint reads the checkpoint from file. A missing file is an empty
+// checkpoint.
+func loadCheckpoint(file string) (*checkpoint, error) {
+	cp := &checkpoint{file: file, Sources: map[string]map[string]*checkpointRepo{}}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+		return cp, err
+	}
+	err = json.Unmarshal(b, cp)
+	if cp.Sources == nil {
+		cp.Sources = map[string]map[string]*checkpointRepo{}
+	}
+	return cp, err
+}
+
+// done reports whether repo of source completed in the interrupted run and
+// has not changed since.
+func (cp *checkpoint) done(source *Source, repo *Repo) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	r := cp.Sources[source.String()][repo.PathWithNamespace]
+	return r != nil && r.Remote == source.remote(repo) && r.LastActivityAt.Equal(repo.LastActivityAt)
+}
+
+// mark records repo of source as complete and writes the checkpoint if the
+// last write is older than checkpointInterval.
+func (cp *checkpoint) mark(source *Source, repo *Repo) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	repos := cp.Sources[source.String()]
+	if repos == nil {
+		repos = map[string]*checkpointRepo{}
+		cp.Sources[source.String()] = repos
+	}
+	repos[repo.PathWithNamespace] = &checkpointRepo{Remote: source.remote(repo), LastActivityAt: repo.LastActivityAt}
+	if time.Since(cp.saved) >= checkpointInterval {
+		cp.write()
+	}
+}
+
+// save writes the checkpoint.
+func (cp *checkpoint) save() {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.write()
+}
+
+func (cp *checkpoint) write() {
+	cp.saved = time.Now()
+	b, err := json.Marshal(cp)
+	if err == nil {
+		err = writeFileAtomic(cp.file, b)
+	}
+	if err != nil {
+		warnf("Failed to save checkpoint [%s]: %s", cp.file, err)
+	}
+}
+
+// clear removes the checkpoint after a run without failures.
+func (cp *checkpoint) clear() {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Sources = map[string]map[string]*checkpointRepo{}
+	err := os.Remove(cp.file)
+	if err != nil && !os.IsNotExist(err) {
+		warnf("Failed to remove checkpoint [%s]: %s", cp.file, err)
+	}
+}
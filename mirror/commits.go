@@ -0,0 +1,63 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var lastCommits = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// resetLastCommits empties the cache so every run sees fresh dates.
+func resetLastCommits() {
+	lastCommits.Lock()
+	lastCommits.m = map[string]time.Time{}
+	lastCommits.Unlock()
+}
+
+// lastCommit returns the committed date of the latest commit on the default
+// branch of repo. Results are cached for the run, so each repo costs at
+// most one extra API call per run. The zero time is returned for non-GitLab
+// sources.
+func lastCommit(ctx context.Context, source *Source, repo *Repo) (time.Time, error) {
+	if source.kind() != "gitlab" {
+		return time.Time{}, nil
+	}
+	key := fmt.Sprintf("%s/%d", source.Domain, repo.ID)
+	lastCommits.Lock()
+	t, ok := lastCommits.m[key]
+	lastCommits.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	url := fmt.Sprintf("%s/api/v4/projects/%d/repository/commits?per_page=1", source.baseURL(), repo.ID)
+	resp, err := apiGet(ctx, source, url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return time.Time{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var commits []struct {
+		CommittedDate time.Time `json:"committed_date"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&commits)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(commits) > 0 {
+		t = commits[0].CommittedDate
+	}
+
+	lastCommits.Lock()
+	lastCommits.m[key] = t
+	lastCommits.Unlock()
+	return t, nil
+}
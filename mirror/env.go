@@ -0,0 +1,42 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// applyEnv overrides config file values with the environment:
+//
+//	MIRROR_DESTINATION       Destination
+//	MIRROR_CONCURRENCY       Concurrency
+//	MIRROR_INTERVAL          Interval, a duration such as 1h
+//	MIRROR_SOURCE_<N>_TOKEN  Token of the Nth source, counting from 1
+//
+// Flags in turn override the environment.
+func applyEnv(config *Config) error {
+	if v, ok := os.LookupEnv("MIRROR_DESTINATION"); ok {
+		config.Destination = v
+	}
+	if v, ok := os.LookupEnv("MIRROR_CONCURRENCY"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MIRROR_CONCURRENCY: %w", err)
+		}
+		config.Concurrency = n
+	}
+	if v, ok := os.LookupEnv("MIRROR_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("MIRROR_INTERVAL: %w", err)
+		}
+		config.Interval = Duration(d)
+	}
+	for i, source := range config.Sources {
+		if v, ok := os.LookupEnv(fmt.Sprintf("MIRROR_SOURCE_%d_TOKEN", i+1)); ok {
+			source.Token = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// FailureReason classifies why a repo failed, so a report can tell auth
+// problems from network trouble from a full disk.
+type FailureReason string
+
+const (
+	FailureAuth     FailureReason = "auth"
+	FailureNotFound FailureReason = "not_found"
+	FailureNetwork  FailureReason = "network"
+	FailureTimeout  FailureReason = "timeout"
+	FailureDisk     FailureReason = "disk"
+	FailureCorrupt  FailureReason = "corrupt"
+	FailureUnknown  FailureReason = "unknown"
+)
+
+// failureMarkers are the substrings of a failure message and git stderr
+// that identify each reason, checked in this order.
+var failureMarkers = []struct {
+	reason  FailureReason
+	markers []string
+}{
+	{FailureDisk, []string{"No space left on device", "Disk quota exceeded", "insufficient disk space"}},
+	{FailureTimeout, []string{"timed out", "Operation too slow", "Connection timed out"}},
+	{FailureAuth, []string{"returned error: 401", "returned error: 403", "HTTP Basic: Access denied", "Authentication failed", "could not read Username", "terminal prompts disabled", "Permission denied (publickey", "authentication failed"}},
+	{FailureNotFound, []string{"returned error: 404", "not found", "does not appear to be a git repository", "does not exist"}},
+	{FailureNetwork, []string{"Could not resolve host", "Failed to connect", "Connection refused", "Connection reset", "early EOF", "unexpected disconnect", "the remote end hung up", "returned error: 502", "returned error: 503", "returned error: 504", "RPC failed"}},
+	{FailureCorrupt, []string{"fsck error", "corrupt", "bad object", "missing blob", "missing tree", "missing commit", "did not receive expected object", "not a valid repository", "index-pack failed", "loose object"}},
+}
+
+// classify returns the reason of a failure with message msg caused by the
+// errors among args: API errors by their status, git errors by their
+// stderr and everything else by the message.
+func classify(msg string, args []any) FailureReason {
+	text := msg
+	for _, arg := range args {
+		err, ok := arg.(error)
+		if !ok {
+			continue
+		}
+		var ae *apiError
+		if errors.As(err, &ae) {
+			switch ae.StatusCode {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				return FailureAuth
+			case http.StatusNotFound:
+				return FailureNotFound
+			}
+			if ae.StatusCode >= 500 || ae.StatusCode == http.StatusTooManyRequests {
+				return FailureNetwork
+			}
+		}
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+			return FailureDisk
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return FailureTimeout
+		}
+		var ge *gitError
+		if errors.As(err, &ge) {
+			text += "\n" + ge.stderr
+		}
+		var ne net.Error
+		if errors.As(err, &ne) {
+			if ne.Timeout() {
+				return FailureTimeout
+			}
+			return FailureNetwork
+		}
+	}
+	for _, m := range failureMarkers {
+		for _, marker := range m.markers {
+			if strings.Contains(text, marker) {
+				return m.reason
+			}
+		}
+	}
+	return FailureUnknown
+}
+
+// failureSummary formats counts by reason as "network:30 auth:5", most
+// frequent first.
+func failureSummary(counts map[FailureReason]int) string {
+	var reasons []FailureReason
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if counts[reasons[i]] != counts[reasons[j]] {
+			return counts[reasons[i]] > counts[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	var parts []string
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%s:%d", reason, counts[reason]))
+	}
+	return strings.Join(parts, " ")
+}
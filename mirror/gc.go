@@ -0,0 +1,143 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func gc(ctx context.Context, local, maxPackSize string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, "-C", local, "-c", "pack.packSizeLimit="+maxPackSize, "gc", "--aggressive", "--prune=now")
+}
+
+// needsGC reports whether the maintenance gc is due for the mirror at
+// local: always with -gc, when it has more loose objects than
+// Config.LooseObjectThreshold, or when the last gc is older than
+// Config.GCInterval.
+func needsGC(config *Config, local string) bool {
+	if config.ForceGC {
+		return true
+	}
+	if config.LooseObjectThreshold > 0 {
+		_, loose, err := objects(local)
+		if err == nil && loose > int64(config.LooseObjectThreshold) {
+			return true
+		}
+	}
+	if config.GCInterval > 0 {
+		out, _ := gitOutput(nil, "-C", local, "config", "--local", "--get", "mirror.lastgc")
+		last, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		return time.Since(time.Unix(last, 0)) > time.Duration(config.GCInterval)
+	}
+	return false
+}
+
+// tooLoose reports whether loose objects exceed
+// Config.RepackLooseObjectThreshold.
+func tooLoose(config *Config, loose int64) bool {
+	return config.RepackLooseObjectThreshold > 0 && loose > int64(config.RepackLooseObjectThreshold)
+}
+
+// repackLoose repacks the updated mirror at local when it has accumulated
+// more loose objects than Config.RepackLooseObjectThreshold.
+func repackLoose(ctx context.Context, config *Config, stat *Stat, local string, w io.Writer) {
+	if config.RepackLooseObjectThreshold <= 0 {
+		return
+	}
+	_, loose, err := objects(local)
+	if err != nil {
+		warnf("Failed to count objects of [%s]: %s", local, err)
+		return
+	}
+	if !tooLoose(config, loose) {
+		return
+	}
+	debugf("Should repack [%s]. objects loose=%d", local, loose)
+	rctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+	started := time.Now()
+	_, err = repack(rctx, local, config.maxPackSize(), w)
+	stat.repackTime += time.Since(started)
+	cancel()
+	if err != nil {
+		stat.failf("Failed repack [%s]: %s", local, err)
+		return
+	}
+	debugf("Repack [%s] finished.", local)
+}
+
+// hasBitmap reports whether the mirror at local has a pack with a
+// reachability bitmap.
+func hasBitmap(local string) bool {
+	matches, _ := filepath.Glob(filepath.Join(gitdir(local), "objects", "pack", "*.bitmap"))
+	return len(matches) > 0
+}
+
+// optimize repacks the mirror at local into a single pack with a
+// reachability bitmap and sets repack.writeBitmaps so later repacks and gcs
+// keep one, when Config.EnableBitmaps is set and it has none yet. Shallow
+// and empty mirrors, and mirrors whose packs must be split by MaxPackSize,
+// cannot have bitmaps and are left alone; a failure is only logged.
+func optimize(ctx context.Context, config *Config, stat *Stat, local string, w io.Writer) {
+	if !config.EnableBitmaps || hasBitmap(local) {
+		return
+	}
+	if fi, err := os.Stat(filepath.Join(gitdir(local), "shallow")); err == nil && fi.Size() > 0 {
+		debugf("Skipped bitmaps of [%s]: shallow mirror", local)
+		return
+	}
+	if n, err := refs(local); err != nil || n == 0 {
+		debugf("Skipped bitmaps of [%s]: no refs", local)
+		return
+	}
+	if largest, _, err := objects(local); err == nil && largest > config.repackThreshold() {
+		debugf("Skipped bitmaps of [%s]: packs are split by MaxPackSize", local)
+		return
+	}
+	_, err := runGit(w, "-C", local, "config", "--local", "repack.writeBitmaps", "true")
+	if err != nil {
+		warnf("Failed to enable bitmaps of [%s]: %s", local, err)
+		return
+	}
+	rctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+	started := time.Now()
+	_, err = runGitContext(rctx, w, "-C", local, "repack", "-a", "-d", "-b")
+	stat.repackTime += time.Since(started)
+	cancel()
+	if err != nil {
+		warnf("Failed to write bitmaps of [%s]: %s", local, err)
+		return
+	}
+	if !hasBitmap(local) {
+		warnf("Repack of [%s] wrote no bitmap", local)
+		return
+	}
+	stat.Optimized++
+}
+
+// maintain runs the maintenance gc of the mirror at local if it is due.
+// Since gc.auto is disabled on mirrors this is the only gc they get. Packs
+// are still limited to MaxPackSize so this does not undo the repack of large
+// mirrors.
+func maintain(ctx context.Context, config *Config, stat *Stat, local string, w io.Writer) {
+	if !needsGC(config, local) {
+		return
+	}
+	debugf("Running gc [%s]", local)
+	gctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+	_, err := gc(gctx, local, config.maxPackSize(), w)
+	cancel()
+	if err == nil {
+		_, err = runGit(w, "-C", local, "config", "--local", "mirror.lastgc", fmt.Sprint(time.Now().Unix()))
+	}
+	if err != nil {
+		stat.failf("Failed gc [%s]: %s", local, err)
+		return
+	}
+	stat.GCed++
+}
@@ -0,0 +1,145 @@
+package mirror
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// generation is a staged copy of a source's mirror tree used by
+// Source.AtomicGeneration. The staging tree is seeded from the live tree with
+// hard links, and copies of the few files rewritten in place, so the double
+// copy only costs the space of what changed in this run. It is swapped in
+// only when every repo of the source succeeded and the previous generation
+// is kept for rollback.
+type generation struct {
+	live     string
+	staging  string
+	previous string
+}
+
+func stage(config *Config, source *Source) (*generation, error) {
+	live := filepath.Join(source.destination(config), source.dir())
+	gen := &generation{
+		live:     live,
+		staging:  live + ".staging",
+		previous: live + ".previous",
+	}
+	err := os.RemoveAll(gen.staging)
+	if err != nil {
+		return nil, err
+	}
+	err = linkTree(gen.live, gen.staging)
+	if err != nil {
+		os.RemoveAll(gen.staging)
+		return nil, err
+	}
+	sourcesMu.Lock()
+	source.root = gen.staging
+	sourcesMu.Unlock()
+	return gen, nil
+}
+
+func (gen *generation) finish(source *Source, stat *Stat, complete bool) {
+	sourcesMu.Lock()
+	source.root = ""
+	sourcesMu.Unlock()
+	if !complete || stat.Failed > 0 || stat.FailedMirror > 0 || stat.FailedUpdate > 0 {
+		infof("Source [%s] generation incomplete, keeping live generation [%s] and staging [%s]", source, gen.live, gen.staging)
+		return
+	}
+	err := os.RemoveAll(gen.previous)
+	if err != nil {
+		warnf("Failed to remove previous generation [%s]: %s", gen.previous, err)
+		return
+	}
+	err = os.Rename(gen.live, gen.previous)
+	if err != nil && !os.IsNotExist(err) {
+		warnf("Failed to retire live generation [%s]: %s", gen.live, err)
+		return
+	}
+	err = os.Rename(gen.staging, gen.live)
+	if err != nil {
+		warnf("Failed to swap in generation [%s] -> [%s]: %s", gen.staging, gen.live, err)
+		os.Rename(gen.previous, gen.live)
+		return
+	}
+	infof("Source [%s] generation swapped in [%s], previous kept at [%s]", source, gen.live, gen.previous)
+}
+
+// linkTree recreates the tree at src under dst, hard linking regular files
+// except those rewritten in place, which are copied so writing them in dst
+// leaves src unchanged. A missing src produces an empty dst.
+func linkTree(src, dst string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == src {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case rewritten(rel):
+			return copyFile(path, target)
+		default:
+			return os.Link(path, target)
+		}
+	})
+}
+
+// rewritten reports whether the file at rel in a mirror is written in place
+// rather than replaced by a rename: FETCH_HEAD, config and description, and
+// the reflogs git appends to.
+func rewritten(rel string) bool {
+	switch filepath.Base(rel) {
+	case "FETCH_HEAD", "config", "description":
+		return true
+	}
+	for _, dir := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if dir == "logs" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the regular file src to dst with its permissions.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if _err := out.Close(); err == nil {
+		err = _err
+	}
+	return err
+}
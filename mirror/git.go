@@ -0,0 +1,192 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gitCommands is the set of git subcommands the tool is allowed to run. It
+// defaults to every subcommand the tool uses and can be narrowed with
+// Config.AllowedGitCommands.
+var gitCommands = map[string]bool{
+	"bundle":        true,
+	"cat-file":      true,
+	"clone":         true,
+	"config":        true,
+	"count-objects": true,
+	"fetch":         true,
+	"for-each-ref":  true,
+	"fsck":          true,
+	"gc":            true,
+	"init":          true,
+	"lfs":           true,
+	"ls-remote":     true,
+	"pull":          true,
+	"push":          true,
+	"remote":        true,
+	"repack":        true,
+	"rev-parse":     true,
+	"symbolic-ref":  true,
+	"version":       true,
+}
+
+// gitBinary is the git executable and gitFlags the -c key=value flags
+// given to every git command, set from Config.GitBinary and
+// Config.GitConfig.
+var (
+	gitBinary = "git"
+	gitFlags  []string
+)
+
+// setGit sets the git executable and the config passed to every git
+// command. Keys are sorted so the command lines are stable.
+func setGit(binary string, config map[string]string) {
+	if binary != "" {
+		gitBinary = binary
+	}
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	gitFlags = nil
+	for _, k := range keys {
+		gitFlags = append(gitFlags, "-c", k+"="+config[k])
+	}
+}
+
+// allowGit restricts gitCommands to allowed. An empty list keeps the
+// defaults; listing a subcommand the tool does not use is an error.
+func allowGit(allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	restricted := map[string]bool{}
+	for _, c := range allowed {
+		if !gitCommands[c] {
+			return fmt.Errorf("git subcommand '%s' is not used by this tool", c)
+		}
+		restricted[c] = true
+	}
+	gitCommands = restricted
+	return nil
+}
+
+// stderrLines is how many trailing lines of stderr a gitError reports.
+const stderrLines = 5
+
+type gitError struct {
+	err    error
+	stderr string
+}
+
+// Error returns the exit error followed by the last lines of stderr, which
+// usually hold git's reason for failing.
+func (e *gitError) Error() string {
+	tail := lastLines(e.stderr, stderrLines)
+	if tail == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.err, redact(tail))
+}
+
+// lastLines returns the last n non-empty lines of s joined by " | ".
+// Progress output rewritten in place with carriage returns counts as
+// separate lines.
+func lastLines(s string, n int) string {
+	var lines []string
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " | ")
+}
+
+func (e *gitError) Unwrap() error {
+	return e.err
+}
+
+// gitCommand builds a git command for args after checking its subcommand
+// against the allowlist.
+func gitCommand(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	subcommand := ""
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-C" || args[i] == "-c" {
+			i++
+			continue
+		}
+		subcommand = args[i]
+		break
+	}
+	if !gitCommands[subcommand] {
+		return nil, fmt.Errorf("git subcommand '%s' is not allowed", subcommand)
+	}
+	cmd := exec.CommandContext(ctx, gitBinary, append(gitFlags[:len(gitFlags):len(gitFlags)], args...)...)
+	killGroup(cmd)
+	return cmd, nil
+}
+
+func runGit(w io.Writer, args ...string) (*exec.Cmd, error) {
+	return runGitContext(context.Background(), w, args...)
+}
+
+func runGitContext(ctx context.Context, w io.Writer, args ...string) (*exec.Cmd, error) {
+	cmd, err := gitCommand(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	err = execute(cmd, w)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return cmd, fmt.Errorf("timed out: %w", err)
+	}
+	return cmd, err
+}
+
+// gitOutput runs git with stdin and returns its stdout.
+func gitOutput(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd, err := gitCommand(context.Background(), args...)
+	if err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	err = execute(cmd, nil)
+	return stdout.Bytes(), err
+}
+
+var userinfo = regexp.MustCompile(`://([^:/@\s]+):[^@/\s]+@`)
+
+// redact masks passwords and tokens embedded as userinfo in URLs within s.
+func redact(s string) string {
+	return userinfo.ReplaceAllString(s, "://$1:***@")
+}
+
+func execute(cmd *exec.Cmd, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if w != nil {
+		fmt.Fprintf(w, "%s $ %s\n", time.Now().Format(time.RFC3339), redact(strings.Join(cmd.Args, " ")))
+		cmd.Stdout = w
+		cmd.Stderr = io.MultiWriter(w, &stderr)
+	}
+	cmd.Env = append(append(os.Environ(), gitEnv...), "GIT_TERMINAL_PROMPT=0")
+	err := cmd.Run()
+	if err != nil {
+		return &gitError{err: err, stderr: stderr.String()}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// gitea lists repos through the Gitea/Forgejo /api/v1/repos/search
+// endpoint, which returns every repo the token can see.
+type gitea struct{}
+
+func (gitea) Get(ctx context.Context, config *Config, source *Source, path string) (*Repo, error) {
+	r := &githubRepo{}
+	err := getJSON(ctx, config, source, "["+path+"]", source.baseURL()+"/api/v1/repos/"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	return r.repo(), nil
+}
+
+func (gitea) List(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	var repos []*Repo
+	limit := 50
+	total := 0
+	for page := 1; ; page++ {
+		var p struct {
+			Data []*githubRepo `json:"data"`
+		}
+		url := fmt.Sprintf("%s/api/v1/repos/search?page=%d&limit=%d", source.baseURL(), page, limit)
+		err := retry(ctx, config, fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, func() error {
+			resp, err := apiGet(ctx, source, url)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			err = checkStatus(source, resp)
+			if err != nil {
+				return err
+			}
+			if page == 1 {
+				total, _ = strconv.Atoi(resp.Header.Get("X-Total-Count"))
+			}
+			return json.NewDecoder(resp.Body).Decode(&p)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(p.Data) == 0 {
+			break
+		}
+		for _, r := range p.Data {
+			repos = append(repos, r.repo())
+		}
+		if total > 0 && len(repos) >= total {
+			break
+		}
+	}
+	return dedup(source, repos), total, nil
+}
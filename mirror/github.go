@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// github lists repos through the GitHub REST API, either those of
+// Source.Org or all repos the token's user has access to. github.com is
+// served from api.github.com, GitHub Enterprise from <Domain>/api/v3, unless
+// APIBaseURL gives the API root.
+type github struct{}
+
+type githubRepo struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	FullName      string    `json:"full_name"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	CloneURL      string    `json:"clone_url"`
+	SSHURL        string    `json:"ssh_url"`
+	Description   string    `json:"description"`
+	DefaultBranch string    `json:"default_branch"`
+	Topics        []string  `json:"topics"`
+	Archived      bool      `json:"archived"`
+	Size          int64     `json:"size"`
+	Visibility    string    `json:"visibility"`
+	Private       bool      `json:"private"`
+	Internal      bool      `json:"internal"`
+	Owner         struct {
+		ID    int    `json:"id"`
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+// repo maps a GitHub repo onto Repo. Gitea returns the same shape.
+func (r *githubRepo) repo() *Repo {
+	repo := &Repo{
+		ID:                r.ID,
+		Name:              r.Name,
+		NameWithNamespace: r.FullName,
+		Path:              r.Name,
+		PathWithNamespace: r.FullName,
+		CreatedAt:         r.CreatedAt,
+		LastActivityAt:    r.UpdatedAt,
+		HTTPURLToRepo:     r.CloneURL,
+		SSHURLToRepo:      r.SSHURL,
+		Description:       r.Description,
+		DefaultBranch:     r.DefaultBranch,
+		Topics:            r.Topics,
+		Archived:          r.Archived,
+		Visibility:        r.Visibility,
+	}
+	if repo.Visibility == "" {
+		switch {
+		case r.Internal:
+			repo.Visibility = "internal"
+		case r.Private:
+			repo.Visibility = "private"
+		default:
+			repo.Visibility = "public"
+		}
+	}
+	repo.Statistics.RepositorySize = r.Size * 1024
+	repo.Namespace.ID = r.Owner.ID
+	repo.Namespace.FullPath = r.Owner.Login
+	return repo
+}
+
+func (github) api(source *Source) string {
+	if source.APIBaseURL != "" {
+		return strings.TrimRight(source.APIBaseURL, "/")
+	}
+	if source.Domain == "github.com" {
+		return "https://api.github.com"
+	}
+	return source.baseURL() + "/api/v3"
+}
+
+func (g github) Get(ctx context.Context, config *Config, source *Source, path string) (*Repo, error) {
+	r := &githubRepo{}
+	err := getJSON(ctx, config, source, "["+path+"]", g.api(source)+"/repos/"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	return r.repo(), nil
+}
+
+func (g github) List(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	url := g.api(source) + "/user/repos?per_page=100"
+	if source.Org != "" {
+		url = fmt.Sprintf("%s/orgs/%s/repos?per_page=100", g.api(source), source.Org)
+	}
+	var repos []*Repo
+	for page := 1; url != ""; page++ {
+		var p []*githubRepo
+		next := ""
+		err := retry(ctx, config, fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, func() error {
+			resp, err := apiGet(ctx, source, url)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			err = checkStatus(source, resp)
+			if err != nil {
+				return err
+			}
+			next = nextLink(resp.Header.Get("Link"))
+			return json.NewDecoder(resp.Body).Decode(&p)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, r := range p {
+			repos = append(repos, r.repo())
+		}
+		url = next
+	}
+	return dedup(source, repos), 0, nil
+}
@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type health struct {
+	mu            sync.Mutex
+	running       bool
+	ready         bool
+	lastStarted   time.Time
+	lastCompleted time.Time
+	lastSucceeded bool
+	lastSuccess   time.Time
+	counts        map[string]int
+	// staleAfter makes /readyz fail when no run succeeded within it, so a
+	// daemon that stopped making progress is taken out of service.
+	staleAfter time.Duration
+}
+
+func (h *health) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = true
+	h.lastStarted = time.Now()
+}
+
+func (h *health) finish(succeeded bool, stats []*Stat) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = false
+	h.lastCompleted = time.Now()
+	h.lastSucceeded = succeeded
+	if succeeded {
+		h.ready = true
+		h.lastSuccess = h.lastCompleted
+	}
+	h.counts = map[string]int{}
+	for _, stat := range stats {
+		h.counts["mirrored"] += stat.Mirrored
+		h.counts["updated"] += stat.Updated
+		h.counts["skipped"] += stat.Skipped
+		h.counts["failed"] += stat.Failed + stat.FailedMirror + stat.FailedUpdate
+	}
+}
+
+func (h *health) status() map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ready := h.ready
+	if ready && h.staleAfter > 0 && time.Since(h.lastSuccess) > h.staleAfter {
+		ready = false
+	}
+	status := map[string]any{
+		"running":        h.running,
+		"ready":          ready,
+		"last_succeeded": h.lastSucceeded,
+	}
+	if h.counts != nil {
+		status["last_counts"] = h.counts
+	}
+	if !h.lastStarted.IsZero() {
+		status["last_started"] = h.lastStarted
+	}
+	if !h.lastCompleted.IsZero() {
+		status["last_completed"] = h.lastCompleted
+	}
+	return status
+}
+
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK, h.status())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := h.status()
+		code := http.StatusOK
+		if !status["ready"].(bool) {
+			code = http.StatusServiceUnavailable
+		}
+		writeStatus(w, code, status)
+	})
+	return mux
+}
+
+func (h *health) serve(addr string) error {
+	return http.ListenAndServe(addr, h.handler())
+}
+
+func writeStatus(w http.ResponseWriter, code int, status map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
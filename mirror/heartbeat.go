@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatInterval is how often the -progress line is printed.
+const heartbeatInterval = 2 * time.Second
+
+// heartbeat counts the repos of a source processed so far while work runs,
+// enabled with -progress. The heartbeats of all sources are printed by one
+// shared reporter through stderr, so with several sources at once their
+// progress shares one line on a terminal and does not interleave with the
+// log.
+type heartbeat struct {
+	source *Source
+	total  int
+	done   atomic.Int64
+	failed atomic.Int64
+}
+
+// heartbeats is the reporter: the heartbeats of the sources in progress and
+// the ticker printing them, running while there are any.
+var heartbeats struct {
+	mu     sync.Mutex
+	beats  []*heartbeat
+	stop   chan struct{}
+	exited chan struct{}
+}
+
+// startHeartbeat starts reporting the progress of total repos of source.
+func startHeartbeat(source *Source, total int) *heartbeat {
+	h := &heartbeat{source: source, total: total}
+	heartbeats.mu.Lock()
+	defer heartbeats.mu.Unlock()
+	heartbeats.beats = append(heartbeats.beats, h)
+	if len(heartbeats.beats) == 1 {
+		stop, exited := make(chan struct{}), make(chan struct{})
+		heartbeats.stop, heartbeats.exited = stop, exited
+		go func() {
+			defer close(exited)
+			t := time.NewTicker(heartbeatInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-t.C:
+					report()
+				}
+			}
+		}()
+	}
+	return h
+}
+
+// report prints the progress of every source in progress, on a terminal
+// as one line rewritten in place, otherwise as a line per source.
+func report() {
+	heartbeats.mu.Lock()
+	var lines []string
+	for _, h := range heartbeats.beats {
+		lines = append(lines, h.line())
+	}
+	heartbeats.mu.Unlock()
+	if stderr.tty {
+		stderr.setStatus(strings.Join(lines, " | "))
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintln(stderr, line)
+	}
+}
+
+// observe counts a processed repo and whether it failed.
+func (h *heartbeat) observe(s *Stat) {
+	if h == nil {
+		return
+	}
+	h.done.Add(1)
+	if s.Failed+s.FailedMirror+s.FailedUpdate > 0 {
+		h.failed.Add(1)
+	}
+}
+
+func (h *heartbeat) line() string {
+	return fmt.Sprintf("source %s: %d/%d done (%d failed)", h.source, h.done.Load(), h.total, h.failed.Load())
+}
+
+// finish prints the final line of the source and stops reporting it, and
+// stops the reporter after the last source.
+func (h *heartbeat) finish() {
+	if h == nil {
+		return
+	}
+	heartbeats.mu.Lock()
+	for i, b := range heartbeats.beats {
+		if b == h {
+			heartbeats.beats = append(heartbeats.beats[:i], heartbeats.beats[i+1:]...)
+			break
+		}
+	}
+	var stop, exited chan struct{}
+	if len(heartbeats.beats) == 0 {
+		stop, exited = heartbeats.stop, heartbeats.exited
+	}
+	heartbeats.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-exited
+		if stderr.tty {
+			stderr.setStatus("")
+		}
+	}
+	fmt.Fprintln(stderr, h.line())
+	if stop == nil && stderr.tty {
+		report()
+	}
+}
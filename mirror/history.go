@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type HistoryEntry struct {
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration"`
+	Sources  int       `json:"sources"`
+	Repos    int       `json:"repos"`
+	Skipped  int       `json:"skipped"`
+	Mirrored int       `json:"mirrored"`
+	Updated  int       `json:"updated"`
+	Failed   int       `json:"failed"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// appendHistory appends one JSON line with the aggregate stats of a run to
+// Config.StatsHistoryFile. Each entry is written with a single write and
+// synced, so a crash can at worst lose the last line, never corrupt earlier
+// ones.
+func appendHistory(config *Config, started time.Time, stats []*Stat) error {
+	entry := &HistoryEntry{
+		Time:     started,
+		Duration: time.Since(started).Round(time.Second).String(),
+		Sources:  len(stats),
+	}
+	for _, stat := range stats {
+		entry.Repos += len(stat.Repos)
+		entry.Skipped += stat.Skipped
+		entry.Mirrored += stat.Mirrored
+		entry.Updated += stat.Updated
+		entry.Failed += stat.Failed + stat.FailedMirror + stat.FailedUpdate
+	}
+	seen := map[string]bool{}
+	for _, dir := range destinations(config) {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		size, err := du(dir)
+		if err != nil {
+			return err
+		}
+		entry.Bytes += size
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(config.StatsHistoryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	return err
+}
+
+// destinations returns every distinct directory mirrors may be kept in:
+// the source destinations and those of the routing rules.
+func destinations(config *Config) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, source := range config.Sources {
+		add(source.destination(config))
+	}
+	for _, rule := range config.RoutingRules {
+		add(rule.Destination)
+	}
+	return dirs
+}
+
+// destinations returns the directories the source's mirrors may be kept
+// in: its own destination and those of the routing rules, which apply to
+// the repos of every source.
+func (s *Source) destinations(config *Config) []string {
+	dirs := []string{s.destination(config)}
+	for _, rule := range config.RoutingRules {
+		if rule.Destination != "" && !contains(dirs, rule.Destination) {
+			dirs = append(dirs, rule.Destination)
+		}
+	}
+	return dirs
+}
+
+func du(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return
+}
@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"strings"
+)
+
+// strictHost reports whether the source only clones from its own host:
+// StrictHost, AllowedHosts or PinnedIPs is set.
+func (s *Source) strictHost() bool {
+	return s.StrictHost || len(s.AllowedHosts) > 0 || len(s.PinnedIPs) > 0
+}
+
+// hostname returns the host of the source's Domain without the port or a
+// path prefix.
+func (s *Source) hostname() string {
+	host, _, _ := strings.Cut(strings.Trim(s.Domain, "/"), "/")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// remoteHost returns the host name of remote, an URL or an scp-like
+// user@host:path ssh remote.
+func remoteHost(remote string) string {
+	if !strings.Contains(remote, "://") {
+		if _, rest, ok := strings.Cut(remote, "@"); ok {
+			remote = rest
+		}
+		host, _, _ := strings.Cut(remote, ":")
+		return host
+	}
+	u, err := neturl.Parse(remote)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// hostReason returns why remote is refused for a strict source, "" when its
+// host is the source's host or one of AllowedHosts. This guards against an
+// API response, tampered with or from a misconfigured instance, pointing
+// git at an arbitrary host.
+func hostReason(source *Source, remote string) string {
+	if !source.strictHost() {
+		return ""
+	}
+	host := remoteHost(remote)
+	if strings.EqualFold(host, source.hostname()) || containsFold(source.AllowedHosts, host) {
+		return ""
+	}
+	return fmt.Sprintf("clone URL host '%s' is not %s or in AllowedHosts", host, source.hostname())
+}
+
+// pinnedDialer returns a DialContext that connects to ips, tried in order,
+// in place of resolving host. Other hosts are dialed as usual.
+func pinnedDialer(host string, ips []string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil || !strings.EqualFold(h, host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		var last error
+		for _, ip := range ips {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			last = err
+		}
+		return nil, last
+	}
+}
+
+// pinnedGit returns the git options that pin the source's host to PinnedIPs
+// through curl's resolve list and keep git from following redirects to
+// another host, for an http(s) remote of a strict source.
+func pinnedGit(source *Source, remote string) []string {
+	if !source.strictHost() {
+		return nil
+	}
+	u, err := neturl.Parse(remote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	args := []string{"-c", "http.followRedirects=false"}
+	if len(source.PinnedIPs) == 0 || !strings.EqualFold(u.Hostname(), source.hostname()) {
+		return args
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	var ips []string
+	for _, ip := range source.PinnedIPs {
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		ips = append(ips, ip)
+	}
+	return append(args, "-c", fmt.Sprintf("http.curloptResolve=%s:%s:%s", u.Hostname(), port, strings.Join(ips, ",")))
+}
@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// pathData is what PathTemplate is executed with. Domain is the source's
+// Domain flattened into one directory name.
+type pathData struct {
+	Domain            string
+	PathWithNamespace string
+	Path              string
+	ID                int
+}
+
+// layoutTemplate is the compiled PathTemplate, set by compileLayout when the
+// config is validated.
+var layoutTemplate *template.Template
+
+// pathTemplate returns the template of mirror paths relative to the
+// destination, without the .git suffix of bare mirrors.
+func (c *Config) pathTemplate() string {
+	switch {
+	case c.PathTemplate != "":
+		return c.PathTemplate
+	case c.Layout == "id":
+		return "{{.Domain}}/{{.ID}}"
+	}
+	return "{{.Domain}}/{{.PathWithNamespace}}"
+}
+
+// placeholder renders in place of every repo field, so the directories
+// before its first occurrence are the part of the layout shared by all repos
+// of a source.
+const placeholder = "\x00"
+
+// compileLayout parses the path template and checks it against every
+// source: it must render a relative path inside the destination, and one
+// starting with the domain for sources using AtomicGeneration.
+func compileLayout(config *Config) error {
+	t, err := template.New("PathTemplate").Option("missingkey=error").Parse(config.pathTemplate())
+	if err != nil {
+		return fmt.Errorf("invalid PathTemplate: %w", err)
+	}
+	layoutTemplate = t
+	for _, source := range config.Sources {
+		path, err := renderPath(source, &Repo{ID: math.MinInt, Path: placeholder, PathWithNamespace: placeholder})
+		if err != nil {
+			return fmt.Errorf("invalid PathTemplate: %w", err)
+		}
+		if filepath.IsAbs(path) || path == "." || strings.HasPrefix(path, "..") {
+			return fmt.Errorf("PathTemplate '%s' must render a path inside the destination", config.pathTemplate())
+		}
+		if source.AtomicGeneration && layoutRoot(source) != source.dir() && !strings.HasPrefix(layoutRoot(source), source.dir()+string(filepath.Separator)) {
+			return fmt.Errorf("source [%s] uses AtomicGeneration, PathTemplate must start with {{.Domain}}", source)
+		}
+	}
+	return nil
+}
+
+// renderPath executes the path template for repo of source.
+func renderPath(source *Source, repo *Repo) (string, error) {
+	var b strings.Builder
+	err := layoutTemplate.Execute(&b, &pathData{
+		Domain:            source.dir(),
+		PathWithNamespace: repo.PathWithNamespace,
+		Path:              repo.Path,
+		ID:                repo.ID,
+	})
+	return filepath.Clean(filepath.FromSlash(b.String())), err
+}
+
+// layoutRoot returns the directory relative to the destination that holds
+// every mirror of source, the leading directories of the path template that
+// do not depend on the repo.
+func layoutRoot(source *Source) string {
+	path, _ := renderPath(source, &Repo{ID: math.MinInt, Path: placeholder, PathWithNamespace: placeholder})
+	var root []string
+	for _, dir := range strings.Split(path, string(filepath.Separator)) {
+		if strings.Contains(dir, placeholder) || strings.Contains(dir, strconv.Itoa(math.MinInt)) {
+			break
+		}
+		root = append(root, dir)
+	}
+	return filepath.Join(root...)
+}
+
+// link maintains the human-readable symlink of a mirror stored with the id
+// layout. The path the link was created for is recorded in the mirror's git
+// config as mirror.path, so when the project is renamed or moved the stale
+// link is removed and a new one created.
+func link(config *Config, source *Source, repo *Repo, local string, w io.Writer) {
+	name := repo.PathWithNamespace
+	if source.bare() {
+		name += ".git"
+	}
+	root := filepath.Join(destination(config, source, repo), source.dir())
+	if source.root != "" {
+		root = source.root
+	}
+	path := filepath.Join(root, name)
+
+	out, _ := gitOutput(nil, "-C", local, "config", "--local", "--get", "mirror.path")
+	old := string(bytes.TrimSpace(out))
+	if old != "" && old != path {
+		if target, err := os.Readlink(old); err == nil && sameFile(old, target, local) {
+			err = os.Remove(old)
+			if err != nil {
+				warnf("Failed to remove stale link [%s]: %s", old, err)
+			} else {
+				infof("Removed stale link [%s] of renamed repo [%s]", old, repo.PathWithNamespace)
+			}
+		}
+	}
+
+	target, err := filepath.Rel(filepath.Dir(path), local)
+	if err != nil {
+		warnf("Failed to link [%s] -> [%s]: %s", path, local, err)
+		return
+	}
+	if current, err := os.Readlink(path); err != nil || current != target {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			if fi, _err := os.Lstat(path); _err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				os.Remove(path)
+			}
+			err = os.Symlink(target, path)
+		}
+		if err != nil {
+			warnf("Failed to link [%s] -> [%s]: %s", path, local, err)
+			return
+		}
+	}
+	if old != path {
+		_, err = runGit(w, "-C", local, "config", "--local", "mirror.path", path)
+		if err != nil {
+			warnf("Failed to record link [%s] of [%s]: %s", path, local, err)
+		}
+	}
+}
+
+func sameFile(link, target, local string) bool {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	return filepath.Clean(target) == filepath.Clean(local)
+}
@@ -0,0 +1,132 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of active workers for a source and adapts that
+// bound to the rate limit headers returned by the source's API. When the
+// remaining budget drops fast or a 429 is seen the limit is halved, and it
+// ramps back up by one as the budget recovers.
+type limiter struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	max        int
+	limit      int
+	active     int
+	pauseUntil time.Time
+	// sized is set once setMax gave the limiter its bound.
+	sized bool
+}
+
+var limiters sync.Map
+
+// limiterFor returns the limiter of source, shared by its effective copies.
+func limiterFor(source *Source) *limiter {
+	source = source.origin()
+	l, ok := limiters.Load(source)
+	if !ok {
+		l, _ = limiters.LoadOrStore(source, newLimiter(1))
+	}
+	return l.(*limiter)
+}
+
+func newLimiter(max int) *limiter {
+	if max < 1 {
+		max = 1
+	}
+	l := &limiter{max: max, limit: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// setMax sets the upper bound of the limiter and the current limit to it
+// the first time the source's repos are processed. Later calls, such as
+// from webhook repos, keep the limit the API responses adapted.
+func (l *limiter) setMax(max int) {
+	if max < 1 {
+		max = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sized {
+		return
+	}
+	l.sized = true
+	l.max = max
+	l.limit = max
+	l.cond.Broadcast()
+}
+
+func (l *limiter) acquire(ctx context.Context) {
+	l.wait(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// wait blocks until any pause requested by a 429 response has elapsed or
+// ctx is done.
+func (l *limiter) wait(ctx context.Context) {
+	l.mu.Lock()
+	d := time.Until(l.pauseUntil)
+	l.mu.Unlock()
+	if d > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+	}
+}
+
+func (l *limiter) observe(source *Source, resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := l.limit
+	if resp.StatusCode == http.StatusTooManyRequests {
+		limit = limit / 2
+		pause := time.Second
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			pause = time.Duration(s) * time.Second
+		}
+		l.pauseUntil = time.Now().Add(pause)
+		debugf("Source [%s] rate limited, pausing for %s", source, pause)
+	} else {
+		total, err1 := strconv.Atoi(resp.Header.Get("RateLimit-Limit"))
+		remaining, err2 := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+		if err1 != nil || err2 != nil || total <= 0 {
+			return
+		}
+		switch {
+		case remaining*10 < total:
+			limit = limit / 2
+		case remaining*2 > total:
+			limit++
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > l.max {
+		limit = l.max
+	}
+	if limit != l.limit {
+		debugf("Source [%s] limiter adjusted %d -> %d", source, l.limit, limit)
+		l.limit = limit
+		l.cond.Broadcast()
+	}
+}
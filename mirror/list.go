@@ -0,0 +1,58 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// runList prints a table of every repo discovered for every source with the
+// action a run would take, mirror, update, skip or reject, and the reason
+// for skips and rejects.
+// It evaluates the filters only: no git command is run and the commit date
+// filter, which needs an API call per repo, is not applied.
+func runList(config *Config) int {
+	code := ExitOK
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tPATH\tACTION\tREASON")
+	for _, source := range config.Sources {
+		repos, _, err := getRepo(context.Background(), config, source)
+		if err != nil {
+			warnf("Failed to get source [%s] repos. error:'%s'", source, err)
+			code = ExitFailed
+			continue
+		}
+		for _, repo := range repos {
+			action, reason := plan(config, source, repo)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", source, repo.PathWithNamespace, action, reason)
+		}
+	}
+	tw.Flush()
+	return code
+}
+
+// plan returns what a run would do with repo and, for skips and rejects,
+// why.
+func plan(config *Config, source *Source, repo *Repo) (action, reason string) {
+	config, source = effective(config, source, repo)
+	if reason := skipReason(source, repo); reason != "" {
+		return "skip", reason
+	}
+	if reason := hostReason(source, source.remote(repo)); reason != "" {
+		return "reject", reason
+	}
+	if _, err := os.Stat(localPath(config, source, repo)); err != nil {
+		if tooLarge(source, repo) {
+			return "skip", fmt.Sprintf("size %d exceeds MaxRepoSize", repo.Statistics.RepositorySize)
+		}
+		return "mirror", ""
+	}
+	if source.NoUpdate {
+		return "skip", "existing mirror with NoUpdate"
+	}
+	if inactive(source, repo) {
+		return "skip", "no activity within UpdatedSince"
+	}
+	return "update", ""
+}
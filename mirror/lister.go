@@ -0,0 +1,86 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// RepoLister discovers the repos of a source and returns them together with
+// the total the server reported, or 0 if it does not report one. There is
+// one implementation per Source.Type. Canceling ctx ends the listing,
+// retries and rate-limit waits included.
+type RepoLister interface {
+	List(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error)
+}
+
+// RepoGetter is implemented by the listers that can look up a single repo
+// by its path with namespace without listing the whole source.
+type RepoGetter interface {
+	Get(ctx context.Context, config *Config, source *Source, path string) (*Repo, error)
+}
+
+var listers = map[string]RepoLister{
+	"gitlab":    gitlab{},
+	"github":    github{},
+	"gitea":     gitea{},
+	"bitbucket": bitbucket{},
+}
+
+// partialError is returned by a lister together with the repos it listed
+// before a page failed for good. Those repos are still processed, but the
+// listing is incomplete so nothing is pruned.
+type partialError struct {
+	err error
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("listing incomplete: %s", e.err)
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+func (s *Source) kind() string {
+	if s.Type == "" {
+		return "gitlab"
+	}
+	return s.Type
+}
+
+// getJSON decodes the API response for url into v, retrying transient
+// failures like a listing page.
+func getJSON(ctx context.Context, config *Config, source *Source, what, url string, v any) error {
+	return retry(ctx, config, fmt.Sprintf("get %s of [%s]", what, source), transientAPI, func() error {
+		resp, err := apiGet(ctx, source, url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		err = checkStatus(source, resp)
+		if err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
+
+// getRepo lists the repos of source and the total count reported by the
+// API, which is 0 when the API does not report one.
+func getRepo(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	if len(source.ListCommand) > 0 {
+		repos, err := listCommand(ctx, source)
+		return repos, len(repos), err
+	}
+	if source.scheme() == "http" {
+		warnf("Source [%s] uses insecure http, only use this on trusted internal networks", source)
+	}
+	lister, ok := listers[source.kind()]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown source type '%s'", source.Type)
+	}
+	repos, total, err := lister.List(ctx, config, source)
+	languages(ctx, config, source, repos)
+	return repos, total, err
+}
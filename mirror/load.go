@@ -0,0 +1,74 @@
+package mirror
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadPoll is how often the load average is read again while new repos are
+// paused for MaxLoad.
+const loadPoll = 5 * time.Second
+
+// loadMu makes the workers wait for the load one at a time, so a pause is
+// logged once and the workers resume one by one as each recheck passes.
+var loadMu sync.Mutex
+
+var loadUnreadable sync.Once
+
+// loadAverage returns the 1-minute load average from /proc/loadavg, false
+// where it cannot be read.
+func loadAverage() (float64, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
+
+// waitLoad blocks while the load average is above MaxLoad, until it drops
+// or the run is halted. Without MaxLoad, or where the load average is not
+// readable, it returns at once.
+func waitLoad(ctx context.Context, config *Config) {
+	if config.MaxLoad <= 0 {
+		return
+	}
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	paused := false
+	for !halted(ctx) {
+		load, ok := loadAverage()
+		if !ok {
+			loadUnreadable.Do(func() {
+				warnf("Load average is not readable, MaxLoad %g is ignored", config.MaxLoad)
+			})
+			return
+		}
+		if load <= config.MaxLoad {
+			if paused {
+				infof("Resuming new repos: load average %.2f is at most MaxLoad %g", load, config.MaxLoad)
+			}
+			return
+		}
+		if !paused {
+			infof("Pausing new repos: load average %.2f exceeds MaxLoad %g", load, config.MaxLoad)
+			paused = true
+		}
+		select {
+		case <-ctx.Done():
+		case <-stopping:
+		case <-time.After(loadPoll):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mirror
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// console serializes the writes of the log and the -progress reporter to
+// stderr. On a terminal it keeps the progress status line below the log
+// lines: a log line clears the status, is written, and the status is
+// printed again after it.
+type console struct {
+	mu     sync.Mutex
+	tty    bool
+	status string
+}
+
+// stderr is the console logs and progress are written to.
+var stderr = &console{tty: term.IsTerminal(int(os.Stderr.Fd()))}
+
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != "" {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+	n, err := os.Stderr.Write(p)
+	if c.status != "" {
+		fmt.Fprint(os.Stderr, c.status)
+	}
+	return n, err
+}
+
+// setStatus replaces the status line, clearing it when line is empty. It
+// is only used on a terminal.
+func (c *console) setStatus(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+	c.status = line
+}
+
+// setupLogging sets the level below which messages are dropped and the
+// output format, text (default, the standard log format with the level) or
+// json, one object per line.
+func setupLogging(level slog.Level, format string) {
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(stderr, &slog.HandlerOptions{Level: level})))
+		return
+	}
+	log.SetOutput(stderr)
+	slog.SetLogLoggerLevel(level)
+}
+
+// Per-repo progress is logged at debug, outcomes at info, repo failures at
+// warn and problems that need an operator at error.
+
+func debugf(format string, v ...any) {
+	slog.Debug(fmt.Sprintf(format, v...))
+}
+
+func infof(format string, v ...any) {
+	slog.Info(fmt.Sprintf(format, v...))
+}
+
+func warnf(format string, v ...any) {
+	slog.Warn(fmt.Sprintf(format, v...))
+}
+
+func errorf(format string, v ...any) {
+	slog.Error(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,3122 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Source struct {
+	Domain   string   `yaml:"Domain"`
+	Username string   `yaml:"Username"`
+	Token    string   `yaml:"Token"`
+	Exclude  []string `yaml:"Exclude"`
+	Include  []string `yaml:"Include"`
+	// IncludeFile and ExcludeFile name files with one more Include or
+	// Exclude pattern per line, # starting a comment. They are reread
+	// before every run.
+	IncludeFile   string   `yaml:"IncludeFile"`
+	ExcludeFile   string   `yaml:"ExcludeFile"`
+	ExcludeGroups []string `yaml:"ExcludeGroups"`
+	IncludeGroups []string `yaml:"IncludeGroups"`
+	// Scheme is https (default) or http for the API and clones. http sends
+	// the token in clear text, for trusted internal networks only.
+	Scheme string `yaml:"Scheme"`
+	// FetchReleases downloads the asset links of every release of GitLab
+	// repos into <local without .git>.releases/<tag>/. Assets already
+	// there are not downloaded again.
+	FetchReleases bool `yaml:"FetchReleases"`
+	// CommitWithinDays skips updating the existing mirrors of GitLab repos
+	// whose default branch has no commit within this many days. New repos
+	// are always cloned.
+	CommitWithinDays int `yaml:"CommitWithinDays"`
+	// Bare keeps bare mirrors at <path>.git. Default true; false keeps
+	// working tree clones at <path> instead, updated with pull --ff-only.
+	Bare *bool `yaml:"Bare"`
+	// ListCommand is a command and its arguments run in place of the API to
+	// list the repos, which prints a JSON array in the shape of the GitLab
+	// projects API; http_url_to_repo and path_with_namespace are required.
+	ListCommand []string `yaml:"ListCommand"`
+	// Owner only mirrors repos whose namespace has this full path or ID.
+	Owner string `yaml:"Owner"`
+	// AtomicGeneration builds every run of the source in <domain>.staging,
+	// hard linked from the live tree, and swaps it in only when every repo
+	// succeeded, keeping the previous tree at <domain>.previous.
+	AtomicGeneration bool `yaml:"AtomicGeneration"`
+	// Type is the kind of server, gitlab (default), github, gitea or
+	// bitbucket. Org limits a github source to the repos of one
+	// organization, and a bitbucket source to one workspace or project key.
+	Type string `yaml:"Type"`
+	Org  string `yaml:"Org"`
+	// Protocol ssh clones from the repo's ssh URL instead of https and uses
+	// no token; SSHCommand, if set, is used as git's core.sshCommand, e.g.
+	// to select a deploy key.
+	Protocol   string `yaml:"Protocol"`
+	SSHCommand string `yaml:"SSHCommand"`
+	// UpdatedSince skips updating existing mirrors whose last activity is
+	// older than this. New repos are always cloned.
+	UpdatedSince Duration `yaml:"UpdatedSince"`
+	// NoUpdate only clones repos that have no mirror yet and never fetches
+	// into existing ones, keeping them as frozen snapshots. Existing
+	// mirrors are counted as skipped.
+	NoUpdate bool `yaml:"NoUpdate"`
+	// IncludeArchived mirrors archived projects too. They are skipped by
+	// default since they are read-only and rarely wanted in a mirror set.
+	IncludeArchived bool `yaml:"IncludeArchived"`
+	// Visibility, if set, only mirrors repos with one of these visibilities
+	// (public, internal, private). Repos of unknown visibility are skipped.
+	Visibility []string `yaml:"Visibility"`
+	// Concurrency caps the repos of this source processed at once, so one
+	// instance is not hit with every global slot. It defaults to, and can
+	// not exceed, Config.Concurrency.
+	Concurrency int `yaml:"Concurrency"`
+	// LFS fetches every Git LFS object after each mirror and update. It
+	// needs git-lfs installed.
+	LFS bool `yaml:"LFS"`
+	// Wikis also mirrors the wiki of every project that has one enabled,
+	// as a bare mirror at <local without .git>.wiki.git.
+	Wikis bool `yaml:"Wikis"`
+	// Destination overrides Config.Destination for the mirrors of this
+	// source.
+	Destination string `yaml:"Destination"`
+	// Depth, when above zero, keeps shallow mirrors of the last Depth
+	// commits of every branch and tag instead of full --mirror clones.
+	// Shallow mirrors save a lot of space on large repos but cannot be used
+	// to restore the full history, and only branches and tags are fetched.
+	Depth int `yaml:"Depth"`
+	// Snippets also downloads the project snippets of every repo into
+	// <local without .git>.snippets/<snippet id>/.
+	Snippets bool `yaml:"Snippets"`
+	// Metadata writes the full project object and the members of every
+	// GitLab repo to <local without .git>.meta.json, for recreating the
+	// project on restore.
+	Metadata bool `yaml:"Metadata"`
+	// IncludeTopics only mirrors repos with at least one of these topics
+	// and ExcludeTopics skips repos with any of them. IncludeLanguages and
+	// ExcludeLanguages do the same for the primary language of GitLab
+	// repos, which costs an extra API call per repo when set.
+	IncludeTopics    []string `yaml:"IncludeTopics"`
+	ExcludeTopics    []string `yaml:"ExcludeTopics"`
+	IncludeLanguages []string `yaml:"IncludeLanguages"`
+	ExcludeLanguages []string `yaml:"ExcludeLanguages"`
+	// Refs limits bare mirrors to these refs or ref globs, e.g.
+	// refs/heads/main and refs/heads/release/*, instead of every ref.
+	// Changing Refs updates the refspecs of existing mirrors on their next
+	// update; refs no longer listed are left in place.
+	Refs []string `yaml:"Refs"`
+	// Overrides replaces settings for the repos whose path with namespace
+	// matches the key, a glob or a re: regular expression like
+	// IncludePatterns, e.g. a longer CloneTimeout or a Depth for a few
+	// huge repos. Every matching override applies, in key order.
+	Overrides map[string]*Override `yaml:"Overrides"`
+	// MaxRepoSize skips cloning repos whose repository size reported by the
+	// API is larger, e.g. "2GB". Existing mirrors are still updated.
+	MaxRepoSize Size `yaml:"MaxRepoSize"`
+	// Groups lists only the projects of these groups and their subgroups,
+	// given as numeric IDs or full paths, instead of every visible project.
+	Groups []string `yaml:"Groups"`
+	// AutoGroups lists the projects of every group the token has at least
+	// guest access to, as found through /groups, in place of Groups; with a
+	// group access token that is the token's group. When the token reaches
+	// no group, every project visible to it is listed instead.
+	AutoGroups bool `yaml:"AutoGroups"`
+	// Membership and Owned only list projects the token's user is a member
+	// of or owns. Membership applies to the instance-wide listing only.
+	Membership bool `yaml:"Membership"`
+	Owned      bool `yaml:"Owned"`
+	// APIBaseURL is the URL the API paths are appended to, for instances
+	// served under a path prefix, e.g. https://tools.example.com/gitlab.
+	// It defaults to <Scheme>://<Domain>; Domain may also contain the prefix.
+	APIBaseURL string `yaml:"APIBaseURL"`
+	// CACertFile adds a PEM CA bundle to trust for the API and git, for
+	// instances signed by a private CA. InsecureSkipVerify disables TLS
+	// certificate verification entirely, which is INSECURE: anyone on the
+	// network path can intercept the token and the repos. Prefer CACertFile.
+	CACertFile         string `yaml:"CACertFile"`
+	InsecureSkipVerify bool   `yaml:"InsecureSkipVerify"`
+	// StrictHost rejects repos whose clone URL from the API is not on the
+	// Domain's host or one of AllowedHosts, and keeps git from following
+	// redirects. PinnedIPs connects the API and git to these addresses of
+	// the Domain's host instead of resolving it; git needs 2.37 or later,
+	// and neither Proxy nor RateLimit may be set. Setting AllowedHosts or
+	// PinnedIPs implies StrictHost.
+	StrictHost   bool     `yaml:"StrictHost"`
+	AllowedHosts []string `yaml:"AllowedHosts"`
+	PinnedIPs    []string `yaml:"PinnedIPs"`
+	// Prune removes local mirrors under the source's domain that no longer
+	// correspond to a repo on the remote.
+	Prune bool `yaml:"Prune"`
+	// NoPrune keeps refs deleted upstream in the source's mirrors, as an
+	// archive, where updates otherwise fetch with --prune.
+	NoPrune bool `yaml:"NoPrune"`
+	// FailOnEmpty overrides Config.FailOnEmpty for this source; set it to
+	// false for a source that is expected to list no repos.
+	FailOnEmpty *bool `yaml:"FailOnEmpty"`
+	root        string
+	// base is the configured source an effective copy with Overrides
+	// applied was made from.
+	base *Source
+	// activityAfter limits the listing to projects with activity after it
+	// on incremental runs.
+	activityAfter time.Time
+	// moved maps the IDs of renamed projects to their previous mirror path.
+	moved map[int]string
+	// fileInclude and fileExclude hold the patterns read from IncludeFile
+	// and ExcludeFile.
+	fileInclude []string
+	fileExclude []string
+}
+
+// sourcesMu guards the unexported fields of the sources that runs change,
+// root, activityAfter, moved, fileInclude and fileExclude, against webhook
+// workers, which process a snapshot taken under it.
+var sourcesMu sync.RWMutex
+
+func (s *Source) String() string {
+	if s.Username != "" {
+		return fmt.Sprintf("%s@%s", s.Username, s.Domain)
+	}
+	return s.Domain
+}
+
+func (c *Config) keepEmptyDirs() bool {
+	return c.KeepEmptyDirs == nil || *c.KeepEmptyDirs
+}
+
+func (c *Config) pruneRefs() bool {
+	return c.PruneRefs == nil || *c.PruneRefs
+}
+
+// pruneRefs reports whether updates of the source's mirrors remove refs
+// deleted upstream: PruneRefs is not false and NoPrune is not set.
+func (s *Source) pruneRefs(config *Config) bool {
+	return config.pruneRefs() && !s.NoPrune
+}
+
+// concurrency returns the number of repos processed at once, defaulting to
+// the number of CPUs. A value of 1 processes repos sequentially.
+func (c *Config) concurrency() int {
+	if c.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.Concurrency
+}
+
+func (c *Config) sourceConcurrency() int {
+	if c.SourceConcurrency <= 0 {
+		return 1
+	}
+	return c.SourceConcurrency
+}
+
+func (c *Config) pageRetries() int {
+	if c.PageRetries <= 0 {
+		return 3
+	}
+	return c.PageRetries
+}
+
+func (c *Config) emptyPageRetries() int {
+	if c.EmptyPageRetries <= 0 {
+		return c.pageRetries()
+	}
+	return c.EmptyPageRetries
+}
+
+func (c *Config) perPage() int {
+	switch {
+	case c.PerPage <= 0:
+		return 50
+	case c.PerPage > 100:
+		return 100
+	}
+	return c.PerPage
+}
+
+func (c *Config) apiTimeout() time.Duration {
+	if c.APITimeout <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.APITimeout)
+}
+
+func (c *Config) cloneTimeout() time.Duration {
+	if c.CloneTimeout <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(c.CloneTimeout)
+}
+
+func (c *Config) updateTimeout() time.Duration {
+	if c.UpdateTimeout <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.UpdateTimeout)
+}
+
+func (c *Config) repackThreshold() int64 {
+	if c.RepackThreshold <= 0 {
+		return 95 * 1024 * 1024
+	}
+	return int64(c.RepackThreshold)
+}
+
+func (c *Config) maxPackSize() string {
+	if c.MaxPackSize == "" {
+		return "95m"
+	}
+	return c.MaxPackSize
+}
+
+// checkRepack rejects a MaxPackSize that is not a git size or that is larger
+// than the repack threshold.
+func (c *Config) checkRepack() error {
+	s := strings.ToLower(c.maxPackSize())
+	n := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		n, s = 1<<10, strings.TrimSuffix(s, "k")
+	case strings.HasSuffix(s, "m"):
+		n, s = 1<<20, strings.TrimSuffix(s, "m")
+	case strings.HasSuffix(s, "g"):
+		n, s = 1<<30, strings.TrimSuffix(s, "g")
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return fmt.Errorf("invalid MaxPackSize '%s'", c.MaxPackSize)
+	}
+	if v*n > c.repackThreshold() {
+		return fmt.Errorf("MaxPackSize '%s' is larger than RepackThreshold %d, repacked mirrors would still exceed it", c.maxPackSize(), c.repackThreshold())
+	}
+	return nil
+}
+
+func (c *Config) progressFile() string {
+	if c.ProgressFile != "" {
+		return c.ProgressFile
+	}
+	return filepath.Join(c.Destination, ".progress.json")
+}
+
+func (s *Source) failOnEmpty(config *Config) bool {
+	if s.FailOnEmpty != nil {
+		return *s.FailOnEmpty
+	}
+	return config.FailOnEmpty
+}
+
+// bare reports whether the source is mirrored as bare --mirror clones, the
+// default. Non-bare sources are kept as regular checkouts with a working tree
+// that are pulled on update, so they do not get the mirror refspec.
+func (s *Source) bare() bool {
+	return s.Bare == nil || *s.Bare
+}
+
+// remote returns the URL repo is cloned and fetched from, the ssh URL when
+// the source uses the ssh protocol and the repo has one.
+func (s *Source) remote(repo *Repo) string {
+	if s.Protocol == "ssh" && repo.SSHURLToRepo != "" {
+		return repo.SSHURLToRepo
+	}
+	return repo.HTTPURLToRepo
+}
+
+func (s *Source) baseURL() string {
+	if s.APIBaseURL != "" {
+		return strings.TrimRight(s.APIBaseURL, "/")
+	}
+	return fmt.Sprintf("%s://%s", s.scheme(), strings.Trim(s.Domain, "/"))
+}
+
+// dir returns the directory the source's mirrors are kept under, the
+// Domain with any path prefix flattened into a single directory name.
+func (s *Source) dir() string {
+	return strings.ReplaceAll(strings.Trim(s.Domain, "/"), "/", "_")
+}
+
+// refspecs returns the force-updating fetch refspecs for Refs, nil when
+// every ref is mirrored.
+func (s *Source) refspecs() []string {
+	var refspecs []string
+	for _, ref := range s.Refs {
+		refspecs = append(refspecs, fmt.Sprintf("+%s:%s", ref, ref))
+	}
+	return refspecs
+}
+
+// destination returns the directory the source's domain subtree is kept in.
+func (s *Source) destination(config *Config) string {
+	if s.Destination != "" {
+		return s.Destination
+	}
+	return config.Destination
+}
+
+func (s *Source) scheme() string {
+	if s.Scheme == "" {
+		return "https"
+	}
+	return s.Scheme
+}
+
+type Config struct {
+	Sources     []*Source `yaml:"Sources"`
+	Destination string    `yaml:"Destination"`
+	// TouchOnUpdate touches the .gitkeep files of KeepEmptyDirs on every
+	// update too, recreating them where they were removed. Without it they
+	// are only created on clone.
+	TouchOnUpdate bool `yaml:"TouchOnUpdate"`
+	// EmptyPageRetries is how often a full page followed by an empty one is
+	// fetched again while X-Total reports more repos than were listed,
+	// default PageRetries.
+	EmptyPageRetries int `yaml:"EmptyPageRetries"`
+	// KeepEmptyDirs creates refs/.gitkeep and objects/.gitkeep in every new
+	// mirror, and with TouchOnUpdate touches them on update, for tools that
+	// prune empty directories. Default true; false creates neither.
+	KeepEmptyDirs *bool `yaml:"KeepEmptyDirs"`
+	// PageRetries is how often a projects page failing with a 5xx, 429 or
+	// network error is retried with backoff, default 3. When it still fails,
+	// the repos listed so far are processed and the source is marked
+	// discovery_incomplete.
+	PageRetries int `yaml:"PageRetries"`
+	// PerPage is the page size of the GitLab projects listing, default 50
+	// and at most 100, GitLab's maximum.
+	PerPage int `yaml:"PerPage"`
+	// PerRepoLogs writes the output of the git commands of every repo to
+	// .logs/<domain>/<path>.log in the destination of its source.
+	PerRepoLogs bool `yaml:"PerRepoLogs"`
+	// PerRepoLogSize is the size in bytes above which a per-repo log is
+	// rotated to <path>.log.1 before the next operation, default 1MiB.
+	PerRepoLogSize int64 `yaml:"PerRepoLogSize"`
+	// RoutingRules keeps the mirrors of repos with a topic matching one of a
+	// rule's Topics patterns in its Destination instead of the source's. The
+	// first matching rule applies, and the rules apply to every source.
+	RoutingRules []*RoutingRule `yaml:"RoutingRules"`
+	// HealthAddr, if set, serves /healthz, always 200, and /readyz, 503
+	// until a run succeeded, with the state of the last run as JSON.
+	HealthAddr string `yaml:"HealthAddr"`
+	// HealthStaleAfter fails /readyz when the last successful run finished
+	// longer ago than this. It defaults to three times Interval in daemon
+	// mode and is off otherwise.
+	HealthStaleAfter Duration `yaml:"HealthStaleAfter"`
+	// StatsHistoryFile, if set, gets one JSON line with the totals and the
+	// disk usage of the destinations appended after every run.
+	StatsHistoryFile string `yaml:"StatsHistoryFile"`
+	// Debug logs at debug level, as -v does.
+	Debug bool `yaml:"Debug"`
+	// Probe checks with ls-remote that the first repo of a source is
+	// reachable before processing it. When that fails with a network error
+	// every repo of the source is skipped and the source marked unreachable.
+	Probe bool `yaml:"Probe"`
+	// PruneRefs removes the refs deleted upstream on every update, with
+	// fetch --prune. Default true; Source.NoPrune turns it off per source.
+	PruneRefs *bool `yaml:"PruneRefs"`
+	// MaxReposPerRun caps the repos processed per run over all sources.
+	// The next run continues after the last repo processed, as recorded in
+	// ProgressFile, default <Destination>/.progress.json. Zero is no cap.
+	MaxReposPerRun int    `yaml:"MaxReposPerRun"`
+	ProgressFile   string `yaml:"ProgressFile"`
+	// DelayBetweenRepos is how long each worker waits after a repo before
+	// starting the next one, to spare the source. Zero does not wait.
+	DelayBetweenRepos Duration `yaml:"DelayBetweenRepos"`
+	// Layout id keeps mirrors at <domain>/<project ID> instead of their path
+	// with namespace, so renamed and moved projects keep their mirror. It
+	// needs repos with IDs, and a PathTemplate takes precedence over it.
+	Layout string `yaml:"Layout"`
+	// PathTemplate is a text/template of the mirror path relative to the
+	// destination with .Domain, .PathWithNamespace, .Path and .ID, e.g.
+	// {{.ID}} for a flat layout. Bare mirrors get a .git suffix. It
+	// defaults to {{.Domain}}/{{.PathWithNamespace}}, or {{.Domain}}/{{.ID}}
+	// with the id Layout. Changing it re-mirrors every repo at its new path;
+	// Prune only removes old mirrors under the new layout's common root.
+	PathTemplate string `yaml:"PathTemplate"`
+	// FsckOnFetch sets fetch.fsckObjects and transfer.fsckObjects on new
+	// mirrors so corrupt upstream objects are rejected at fetch time. Every
+	// fetched object is checked, which noticeably slows down large fetches.
+	FsckOnFetch bool `yaml:"FsckOnFetch"`
+	// AllowedGitCommands is the allowlist of git subcommands the tool may
+	// run, e.g. clone, fetch and config; the operations needing any other
+	// one fail. It defaults to every subcommand the tool uses, and listing
+	// one it does not use is a config error.
+	AllowedGitCommands []string `yaml:"AllowedGitCommands"`
+	// GitBinary is the git executable to run, default git from PATH.
+	GitBinary string `yaml:"GitBinary"`
+	// GitConfig is passed as -c key=value to every git command, e.g.
+	// http.postBuffer or pack.threads.
+	GitConfig map[string]string `yaml:"GitConfig"`
+	// Concurrency is how many repos are processed at once over all sources,
+	// default the number of CPUs. 1 processes them one after another.
+	Concurrency int `yaml:"Concurrency"`
+	// CloneTimeout and UpdateTimeout bound each git clone and update, whose
+	// git process is killed when they are exceeded, default 30m and 10m.
+	CloneTimeout  Duration `yaml:"CloneTimeout"`
+	UpdateTimeout Duration `yaml:"UpdateTimeout"`
+	// Retries is how often a clone or update failing with a network error,
+	// and an API request failing with one or with a 5xx or 429, is retried,
+	// default 0. RetryBackoff is the wait before the first retry, doubled
+	// for each further one plus jitter, default 2s.
+	Retries      int      `yaml:"Retries"`
+	RetryBackoff Duration `yaml:"RetryBackoff"`
+	// PartialCloneFallback retries a clone that failed because the repo is
+	// too big for the remote, its pack exceeding the size GitLab allows or
+	// the clone timing out, as a partial clone without blobs
+	// (--filter=blob:none). Blobs of such mirrors are fetched from the
+	// remote on demand. Either way these failures count as FailedTooBig.
+	PartialCloneFallback bool `yaml:"PartialCloneFallback"`
+	// FailOnEmpty fails the run when a source lists no repos, which usually
+	// means a revoked token or a wrong domain.
+	FailOnEmpty bool `yaml:"FailOnEmpty"`
+	// IncrementalAfterFirstRun lists only the projects of GitLab sources
+	// with activity since the start of the source's last complete run, as
+	// recorded in the state file. Pruning is skipped on incremental runs
+	// since unchanged repos are not listed.
+	IncrementalAfterFirstRun bool `yaml:"IncrementalAfterFirstRun"`
+	// Manifest writes the path, size, object count and ref tips of every
+	// mirror after each run to ManifestFile, default
+	// <Destination>/manifest.json.
+	Manifest     bool   `yaml:"Manifest"`
+	ManifestFile string `yaml:"ManifestFile"`
+	// MaxConsecutiveFailures skips repos that failed this many runs in a
+	// row, as recorded in the state file, until the config changes or -force
+	// is given. Zero never skips.
+	MaxConsecutiveFailures int `yaml:"MaxConsecutiveFailures"`
+	// MaxFailures is how many failed repos over all sources a run tolerates
+	// and still exits with ExitOK. Zero fails the run on the first one.
+	MaxFailures int `yaml:"MaxFailures"`
+	// SlowestRepos is how many of the slowest repos of each source are
+	// logged and reported, default 5.
+	SlowestRepos int `yaml:"SlowestRepos"`
+	// RunTimeout bounds every run: when it is exceeded no new repo is
+	// started, the git processes in flight are killed and the run exits
+	// with ExitTimeout.
+	RunTimeout Duration `yaml:"RunTimeout"`
+	// SourceCooldown is the minimum time between one source finishing and
+	// the next source on the same domain starting. Sources on other domains
+	// do not wait.
+	SourceCooldown Duration `yaml:"SourceCooldown"`
+	// MaxLoad pauses starting new repos while the system's 1-minute load
+	// average is above it, the repos in flight running on, so a machine
+	// shared with other jobs is not overloaded whatever Concurrency is.
+	// Where the load average cannot be read, /proc/loadavg being Linux only,
+	// Concurrency alone applies. Zero never pauses.
+	MaxLoad float64 `yaml:"MaxLoad"`
+	// SourceConcurrency is how many sources are processed at once, default
+	// 1. Sources on the same domain still run one after another, and every
+	// repo takes a slot of Concurrency and of its source as before. When
+	// several sources list the same repo, the one reaching it first mirrors
+	// it.
+	SourceConcurrency int `yaml:"SourceConcurrency"`
+	force             bool
+	// heartbeat prints a live progress line per source, set by -progress.
+	heartbeat bool
+	// resume skips the repos completed according to checkpoint, set by
+	// -resume for the first run only.
+	resume     bool
+	checkpoint *checkpoint
+	// UserAgent is sent with every API request, default
+	// gitlab-repo-mirror/<version> git/<git version>. APITimeout bounds each
+	// API request including reading its response, default 1m; release
+	// asset downloads are not bounded.
+	UserAgent  string   `yaml:"UserAgent"`
+	APITimeout Duration `yaml:"APITimeout"`
+	// APIRateLimit caps API requests per second to each domain, shared by
+	// every source on that domain. Zero means no client-side limit.
+	APIRateLimit float64 `yaml:"APIRateLimit"`
+	// Proxy is an http, https or socks5 proxy URL for both API and git
+	// traffic. Without it HTTP_PROXY and HTTPS_PROXY are honored.
+	Proxy string `yaml:"Proxy"`
+	// RateLimit caps the aggregate bandwidth of git over HTTP(S), in bytes
+	// per second, by routing it through a local throttling proxy. SSH
+	// remotes are not throttled. The proxy only connects to the Domain and
+	// AllowedHosts of the sources and to PushTo, so clone URLs on any other
+	// host fail. It goes through the http or https proxy HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY set for a host; a socks5 one there keeps it
+	// from starting.
+	RateLimit Size `yaml:"RateLimit"`
+	// DryRun lists and filters repos but only logs what would be mirrored or
+	// updated. Nothing is written to disk and no git subprocess is run.
+	DryRun bool `yaml:"DryRun"`
+	// Verify runs git fsck --full on every new mirror and fails it if
+	// corruption is found. VerifyUpdates does the same after each update.
+	Verify        bool `yaml:"Verify"`
+	VerifyUpdates bool `yaml:"VerifyUpdates"`
+	// StateFile records per-source run times and per-repo last success and
+	// last error, default <Destination>/.state.json.
+	StateFile  string   `yaml:"StateFile"`
+	StaleAfter Duration `yaml:"StaleAfter"`
+	// Interval, if set, keeps the process running and starts a new run this
+	// long after the previous one finished.
+	Interval Duration `yaml:"Interval"`
+	// IntervalJitter moves each wait between runs by a random amount
+	// within ±IntervalJitter, and StartDelay delays the first run by a
+	// random amount below it, spreading the API load of several instances.
+	IntervalJitter Duration `yaml:"IntervalJitter"`
+	StartDelay     Duration `yaml:"StartDelay"`
+	// MinFreeSpace fails the clone of a new repo when the destination
+	// filesystem has less free space, e.g. "10GB". StopOnLowDisk then also
+	// stops the run instead of failing every following clone.
+	MinFreeSpace  Size `yaml:"MinFreeSpace"`
+	StopOnLowDisk bool `yaml:"StopOnLowDisk"`
+	// A new mirror whose largest object file is above RepackThreshold
+	// (default 95MiB) is repacked into packs of at most MaxPackSize (default
+	// 95m, in git's size syntax) for servers that limit file size.
+	// MaxPackSize must not exceed RepackThreshold or every repack would
+	// leave a pack above the threshold.
+	RepackThreshold Size   `yaml:"RepackThreshold"`
+	MaxPackSize     string `yaml:"MaxPackSize"`
+	// RepackLooseObjectThreshold also repacks new mirrors and, after every
+	// update, existing ones with more loose objects than this, so mirrors
+	// kept current by small fetches do not degrade. Zero disables it.
+	RepackLooseObjectThreshold int `yaml:"RepackLooseObjectThreshold"`
+	// EnableBitmaps repacks every mirror without one into a single pack
+	// with a reachability bitmap, which speeds up clones served from the
+	// mirror, and sets repack.writeBitmaps so later gcs keep it.
+	EnableBitmaps bool `yaml:"EnableBitmaps"`
+	// Updated mirrors get a gc --aggressive when their last one is older
+	// than GCInterval or they have more than LooseObjectThreshold loose
+	// objects. ForceGC, set by -gc, runs it on every mirror.
+	GCInterval           Duration `yaml:"GCInterval"`
+	LooseObjectThreshold int      `yaml:"LooseObjectThreshold"`
+	ForceGC              bool     `yaml:"ForceGC"`
+	// MetricsAddr, if set, serves Prometheus metrics on /metrics.
+	MetricsAddr string `yaml:"MetricsAddr"`
+	// WebhookAddr, if set, serves /webhook for GitLab push and tag push
+	// hooks in daemon mode, which mirror or update the pushed repo right
+	// away instead of at the next run. Hooks must send WebhookSecret as
+	// their secret token.
+	WebhookAddr   string `yaml:"WebhookAddr"`
+	WebhookSecret string `yaml:"WebhookSecret"`
+	LogFormat     string `yaml:"LogFormat"`
+	// PushTo pushes every bare mirror to a second GitLab instance after it
+	// was mirrored or updated.
+	PushTo *PushTarget `yaml:"PushTo"`
+	// Bundle writes every mirror that changed as <BundleDir>/<domain>/<path>.bundle
+	// for offline transport. BundleDir defaults to <Destination>/.bundles.
+	// <BundleDir>/SHA256SUMS holds the checksums of the bundles for
+	// sha256sum -c.
+	Bundle    bool   `yaml:"Bundle"`
+	BundleDir string `yaml:"BundleDir"`
+	// S3 uploads every new bundle to an S3 bucket.
+	S3     *S3     `yaml:"S3"`
+	Notify *Notify `yaml:"Notify"`
+	// ReportFormat json writes the per-source stats as JSON at the end of a
+	// run, to ReportFile or stdout, in addition to the log summary.
+	ReportFormat string `yaml:"ReportFormat"`
+	ReportFile   string `yaml:"ReportFile"`
+}
+
+type RoutingRule struct {
+	Topics      []string `yaml:"Topics"`
+	Destination string   `yaml:"Destination"`
+}
+
+// Exit codes returned by the process so automation can branch on the
+// failure category.
+const (
+	ExitOK               = 0 // every source and repo succeeded
+	ExitFailed           = 1 // at least one repo failed to mirror or update
+	ExitConfig           = 2 // config could not be loaded or destination could not be created
+	ExitAllSourcesFailed = 3 // discovery failed for every source
+	ExitInterrupted      = 4 // stopped by a signal before the run finished
+	ExitTimeout          = 5 // RunTimeout was exceeded before the run finished
+	ExitDiscoveryFailed  = 6 // discovery failed for some but not all sources
+)
+
+type Stat struct {
+	mu sync.Mutex
+
+	Source          *Source `json:"-"`
+	Repos           []*Repo `json:"-"`
+	DiscoveryFailed bool    `json:"discovery_failed"`
+	// DiscoveryIncomplete is set when a page failed after some repos were
+	// listed; those repos are processed without pruning.
+	DiscoveryIncomplete bool      `json:"discovery_incomplete"`
+	Total               int       `json:"total"`
+	Unreachable         bool      `json:"unreachable"`
+	Empty               bool      `json:"empty"`
+	Incremental         bool      `json:"incremental"`
+	Skipped             int       `json:"skipped"`
+	Mirrored            int       `json:"mirrored"`
+	Updated             int       `json:"updated"`
+	Moved               int       `json:"moved"`
+	Failed              int       `json:"failed"`
+	FailedMirror        int       `json:"failed_mirror"`
+	FailedUpdate        int       `json:"failed_update"`
+	FailedTooBig        int       `json:"failed_too_big"`
+	RejectedHost        int       `json:"rejected_host"`
+	Drifted             int       `json:"drifted"`
+	Releases            int       `json:"releases"`
+	Snippets            int       `json:"snippets"`
+	Metadata            int       `json:"metadata"`
+	SkippedNoAccess     int       `json:"skipped_no_access"`
+	SkippedArchived     int       `json:"skipped_archived"`
+	SkippedEmpty        int       `json:"skipped_empty"`
+	SkippedTopic        int       `json:"skipped_topic"`
+	SkippedTooLarge     int       `json:"skipped_too_large"`
+	SkippedFailing      int       `json:"skipped_failing"`
+	FailedLFS           int       `json:"failed_lfs"`
+	Wikis               int       `json:"wikis"`
+	FailedWiki          int       `json:"failed_wiki"`
+	Pushed              int       `json:"pushed"`
+	FailedPush          int       `json:"failed_push"`
+	Bundles             int       `json:"bundles"`
+	FailedBundle        int       `json:"failed_bundle"`
+	Uploaded            int       `json:"uploaded"`
+	FailedUpload        int       `json:"failed_upload"`
+	GCed                int       `json:"gced"`
+	Optimized           int       `json:"optimized"`
+	PartialUpdated      int       `json:"partial_updated"`
+	Changed             []string  `json:"changed,omitempty"`
+	Pruned              int       `json:"pruned"`
+	Error               string    `json:"error,omitempty"`
+	Started             time.Time `json:"started"`
+	Finished            time.Time `json:"finished"`
+	Complete            bool      `json:"complete"`
+	results             map[string]*Stat
+	// Slowest lists the repos whose clone, update and repack took longest,
+	// up to Config.SlowestRepos.
+	Slowest []*RepoTiming `json:"slowest,omitempty"`
+	// FailureReasons counts the failed repos by reason and FailedRepos
+	// gives the reason of each.
+	FailureReasons map[FailureReason]int    `json:"failure_reasons,omitempty"`
+	FailedRepos    map[string]FailureReason `json:"failed_repos,omitempty"`
+	// Delta is how the repos of the source changed since the previous run
+	// recorded in the state, unset when there is none.
+	Delta *Delta `json:"delta,omitempty"`
+	// local is the mirror path of a single repo, and cloneTime, updateTime
+	// and repackTime are the durations of its git operations.
+	local      string
+	cloneTime  time.Duration
+	updateTime time.Duration
+	repackTime time.Duration
+	// checkpoint records the repos of the run that completed.
+	checkpoint *checkpoint
+	// reason classifies the last error of a single repo and noAccess is set
+	// when the token was denied access to it.
+	reason   FailureReason
+	noAccess bool
+}
+
+// failf logs a failure of the repo s is the stat of and keeps the message
+// as its last error, classified by classify.
+func (stat *Stat) failf(format string, args ...any) {
+	stat.Error = fmt.Sprintf(format, args...)
+	stat.reason = classify(stat.Error, args)
+	warnf("%s", stat.Error)
+}
+
+// add merges the counters of s, the stat of a single repo, into stat.
+func (stat *Stat) add(repo *Repo, s *Stat) {
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+	if stat.results == nil {
+		stat.results = map[string]*Stat{}
+	}
+	stat.results[repo.PathWithNamespace] = s
+	stat.Skipped += s.Skipped
+	stat.SkippedNoAccess += s.SkippedNoAccess
+	stat.SkippedArchived += s.SkippedArchived
+	stat.SkippedEmpty += s.SkippedEmpty
+	stat.SkippedTopic += s.SkippedTopic
+	stat.SkippedTooLarge += s.SkippedTooLarge
+	stat.FailedLFS += s.FailedLFS
+	stat.Wikis += s.Wikis
+	stat.FailedWiki += s.FailedWiki
+	stat.Pushed += s.Pushed
+	stat.FailedPush += s.FailedPush
+	stat.Bundles += s.Bundles
+	stat.FailedBundle += s.FailedBundle
+	stat.Uploaded += s.Uploaded
+	stat.FailedUpload += s.FailedUpload
+	stat.GCed += s.GCed
+	stat.Optimized += s.Optimized
+	stat.Mirrored += s.Mirrored
+	stat.Updated += s.Updated
+	stat.Moved += s.Moved
+	stat.Failed += s.Failed
+	stat.FailedMirror += s.FailedMirror
+	stat.FailedUpdate += s.FailedUpdate
+	stat.FailedTooBig += s.FailedTooBig
+	stat.RejectedHost += s.RejectedHost
+	stat.PartialUpdated += s.PartialUpdated
+	stat.Drifted += s.Drifted
+	stat.Releases += s.Releases
+	stat.Snippets += s.Snippets
+	stat.Metadata += s.Metadata
+	stat.Changed = append(stat.Changed, s.Changed...)
+	if s.Failed+s.FailedMirror+s.FailedUpdate > 0 {
+		reason := s.reason
+		if reason == "" {
+			reason = FailureUnknown
+		}
+		if stat.FailureReasons == nil {
+			stat.FailureReasons = map[FailureReason]int{}
+			stat.FailedRepos = map[string]FailureReason{}
+		}
+		stat.FailureReasons[reason]++
+		stat.FailedRepos[repo.PathWithNamespace] = reason
+	}
+}
+
+// Main is the command line interface: it parses the flags, loads the config
+// and runs the mode they select, then exits with its exit code.
+func Main() {
+	verbose := flag.Bool("v", false, "log per-repo progress at debug level")
+	showVersion := flag.Bool("version", false, "print the version, commit and build date, then exit")
+	quiet := flag.Bool("q", false, "only log warnings and errors")
+	logFormat := flag.String("log-format", "", "log format, text or json, overrides LogFormat in the config")
+	runTimeout := flag.Duration("timeout", 0, "abort the run after this long, overrides RunTimeout in the config")
+	target := flag.String("repo", "", "mirror or update only this repo, given as its path with namespace or its URL, without listing the sources")
+	list := flag.Bool("list", false, "print the action planned for every discovered repo and why skipped ones are skipped, without running git")
+	check := flag.Bool("check", false, "check the config, git, the destinations and every source's API and token, then exit non-zero if any check fails, without mirroring")
+	verifyOnly := flag.Bool("verify-only", false, "run git fsck on every local mirror and report corrupt ones, without any network access")
+	verifySync := flag.Bool("verify-sync", false, "compare the branch and tag tips of every mirror with its remote's using ls-remote and report drifted mirrors, without fetching")
+	relayout := flag.Bool("relayout", false, "move every mirror recorded in the state file to its path under the current PathTemplate, with -dry-run only print the moves")
+	audit := flag.Bool("audit", false, "report remote repos not mirrored locally and local mirrors with no remote repo, without making changes")
+	configFile := flag.String("config", "", "config file path, .json, .yaml or .yml, or a comma-separated list of files and directories merged in order (default first found of "+strings.Join(configFiles, ", ")+")")
+	dest := flag.String("dest", "", "mirror destination, overrides Destination in the config")
+	reportFormat := flag.String("report", "", "write the run stats in this format (json) to ReportFile or stdout, overrides ReportFormat in the config")
+	pruneAll := flag.Bool("prune", false, "remove local mirrors that no longer exist on the remote, for every source")
+	interval := flag.Duration("interval", 0, "run again after this long instead of exiting, overrides Interval in the config")
+	jitterStart := flag.Duration("jitter-start", 0, "delay the first run by a random time below this, overrides StartDelay in the config")
+	healthAddr := flag.String("health-addr", "", "serve /healthz and /readyz on this address, overrides HealthAddr in the config")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address, overrides MetricsAddr in the config")
+	force := flag.Bool("force", false, "process repos skipped for MaxConsecutiveFailures or for access denied in an earlier run")
+	resume := flag.Bool("resume", false, "skip the repos an interrupted run already completed, as recorded in <Destination>/.checkpoint.json")
+	showProgress := flag.Bool("progress", false, "print a live progress line of each source to stderr every few seconds")
+	forceGC := flag.Bool("gc", false, "run gc --aggressive on every updated mirror, overrides ForceGC in the config")
+	bundleAll := flag.Bool("bundle", false, "write a git bundle of every changed mirror, overrides Bundle in the config")
+	dryRun := flag.Bool("dry-run", false, "log what would be mirrored or updated without touching disk, overrides DryRun in the config")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nEnvironment variables override the config file:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  MIRROR_DESTINATION, MIRROR_CONCURRENCY, MIRROR_INTERVAL, MIRROR_SOURCE_<N>_TOKEN (N counts sources from 1)")
+		fmt.Fprintln(flag.CommandLine.Output(), "Flags take precedence over both where they overlap.")
+	}
+	flag.Parse()
+	if *showVersion {
+		printVersion()
+		os.Exit(ExitOK)
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		errorf("Failed to load config: %s", err)
+		os.Exit(ExitConfig)
+	}
+	if *dest != "" {
+		config.Destination = *dest
+	}
+	if *dryRun {
+		config.DryRun = true
+	}
+	if *runTimeout > 0 {
+		config.RunTimeout = Duration(*runTimeout)
+	}
+	if *interval > 0 {
+		config.Interval = Duration(*interval)
+	}
+	if *jitterStart > 0 {
+		config.StartDelay = Duration(*jitterStart)
+	}
+	if *metricsAddr != "" {
+		config.MetricsAddr = *metricsAddr
+	}
+	if *healthAddr != "" {
+		config.HealthAddr = *healthAddr
+	}
+	if *reportFormat != "" {
+		config.ReportFormat = *reportFormat
+	}
+	invalid := config.Validate()
+	if invalid != nil && !*check {
+		errorf("Invalid config:\n%s", invalid)
+		os.Exit(ExitConfig)
+	}
+	if *force {
+		config.force = true
+	}
+	if *showProgress {
+		config.heartbeat = true
+	}
+	if *resume {
+		config.resume = true
+	}
+	if *forceGC {
+		config.ForceGC = true
+	}
+	if *bundleAll {
+		config.Bundle = true
+	}
+	if *pruneAll {
+		for _, source := range config.Sources {
+			source.Prune = true
+		}
+	}
+	level := slog.LevelInfo
+	switch {
+	case *verbose || config.Debug:
+		level = slog.LevelDebug
+	case *quiet:
+		level = slog.LevelWarn
+	}
+	if *logFormat != "" {
+		config.LogFormat = *logFormat
+	}
+	setupLogging(level, config.LogFormat)
+	err = setup(config)
+	if err != nil {
+		errorf("Failed to load config: %s", err)
+		os.Exit(ExitConfig)
+	}
+	if config.RateLimit > 0 && !config.DryRun {
+		err = startThrottle(config)
+		if err != nil {
+			errorf("Failed to start bandwidth throttle: %s", err)
+			os.Exit(ExitConfig)
+		}
+	}
+
+	if *check {
+		os.Exit(runCheck(config, invalid))
+	}
+	if *audit {
+		os.Exit(runAudit(config))
+	}
+	if *list {
+		os.Exit(runList(config))
+	}
+	if *verifyOnly {
+		os.Exit(runVerify(config))
+	}
+	if *verifySync {
+		os.Exit(runVerifySync(config))
+	}
+	if *relayout {
+		os.Exit(runRelayout(config))
+	}
+
+	if !config.DryRun {
+		for _, dir := range destinations(config) {
+			err = ensureDir(dir)
+			if err != nil {
+				errorf("Failed to create destination directory: %s", err)
+				os.Exit(ExitConfig)
+			}
+		}
+		cleanTemp(config)
+	}
+	if *target != "" {
+		ctx, abort := context.WithCancel(context.Background())
+		handleSignals(abort)
+		os.Exit(runRepo(ctx, config, *target))
+	}
+
+	h := &health{staleAfter: time.Duration(config.HealthStaleAfter)}
+	if h.staleAfter <= 0 && config.Interval > 0 {
+		h.staleAfter = 3 * time.Duration(config.Interval)
+	}
+	if config.HealthAddr != "" {
+		go func() {
+			infof("Serving health checks on [%s]", config.HealthAddr)
+			err := h.serve(config.HealthAddr)
+			if err != nil {
+				warnf("Failed to serve health checks: %s", err)
+			}
+		}()
+	}
+
+	if config.MetricsAddr != "" {
+		go func() {
+			infof("Serving metrics on [%s]", config.MetricsAddr)
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			err := http.ListenAndServe(config.MetricsAddr, mux)
+			if err != nil {
+				warnf("Failed to serve metrics: %s", err)
+			}
+		}()
+	}
+
+	var st *State
+	if !config.DryRun {
+		st, err = loadState(config.stateFile())
+		if err != nil {
+			warnf("Failed to load state [%s]: %s", config.stateFile(), err)
+			st = &State{Sources: map[string]*SourceState{}}
+		}
+	}
+
+	ctx, abort := context.WithCancel(context.Background())
+	handleSignals(abort)
+	if config.WebhookAddr != "" {
+		go func() {
+			infof("Serving webhooks on [%s]", config.WebhookAddr)
+			err := serveWebhook(ctx, config, config.WebhookAddr)
+			if err != nil {
+				warnf("Failed to serve webhooks: %s", err)
+			}
+		}()
+	}
+	infof("Starting gitlab-repo-mirror %s", appVersion())
+	if !startDelay(time.Duration(config.StartDelay)) {
+		os.Exit(ExitInterrupted)
+	}
+	for {
+		_, code := cycle(ctx, config, h, st)
+		if stopped() {
+			os.Exit(ExitInterrupted)
+		}
+		if config.Interval <= 0 {
+			os.Exit(code)
+		}
+		next := time.Now().Add(jittered(time.Duration(config.Interval), time.Duration(config.IntervalJitter)))
+		infof("Next run at %s", next.Format(time.RFC3339))
+		select {
+		case <-stopping:
+			os.Exit(code)
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// cycle does one full run over every source, records its outcome and
+// returns its stats and exit code.
+func cycle(ctx context.Context, config *Config, h *health, st *State) ([]*Stat, int) {
+	resetLastCommits()
+	reloadPatterns(config)
+	h.start()
+	started := time.Now()
+	if config.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.RunTimeout))
+		defer cancel()
+	}
+	config.checkpoint = nil
+	if !config.DryRun {
+		config.checkpoint = &checkpoint{file: config.checkpointFile(), Sources: map[string]map[string]*checkpointRepo{}}
+		if config.resume {
+			cp, err := loadCheckpoint(config.checkpointFile())
+			if err != nil {
+				warnf("Failed to load checkpoint [%s]: %s", config.checkpointFile(), err)
+			}
+			config.checkpoint = cp
+		}
+	}
+	stats := run(ctx, config, st)
+	metrics.record(stats)
+	if st != nil {
+		st.update(stats)
+		for _, stat := range stats {
+			if stat.Delta != nil {
+				infof("Source [%s]: %s since last run", stat.Source, stat.Delta)
+			}
+		}
+		st.ConfigHash = config.hash()
+		err := st.save(config.stateFile())
+		if err != nil {
+			warnf("Failed to save state [%s]: %s", config.stateFile(), err)
+		}
+		st.report(config)
+	}
+	if config.StatsHistoryFile != "" && !config.DryRun {
+		err := appendHistory(config, started, stats)
+		if err != nil {
+			warnf("Failed to append stats history [%s]: %s", config.StatsHistoryFile, err)
+		}
+	}
+	if config.Manifest && !config.DryRun {
+		err := writeManifest(config, stats)
+		if err != nil {
+			warnf("Failed to write manifest [%s]: %s", config.manifestFile(), err)
+		}
+	}
+	if config.ReportFormat != "" {
+		err := writeReport(config.ReportFormat, config.ReportFile, stats)
+		if err != nil {
+			warnf("Failed to write report: %s", err)
+		}
+	}
+	if config.Notify != nil && config.Notify.URL != "" {
+		err := notify(config.Notify, stats)
+		if err != nil {
+			warnf("Failed to notify [%s]: %s", mask(config.Notify.URL), err)
+		}
+	}
+	code := exitCode(config, stats)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		errorf("Run timeout of %s exceeded, the run is incomplete", time.Duration(config.RunTimeout))
+		code = ExitTimeout
+	}
+	complete := code == ExitOK && !stopped()
+	for _, stat := range stats {
+		complete = complete && stat.Complete
+	}
+	if complete {
+		config.checkpoint.clear()
+	} else {
+		config.checkpoint.save()
+	}
+	config.resume = false
+	h.finish(code != ExitAllSourcesFailed, stats)
+	return stats, code
+}
+
+// ensureDir creates dir if needed. An existing directory is fine; an
+// existing file at that path or a permission problem is reported as such.
+func ensureDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("[%s] exists but is not a directory", dir)
+		}
+		return nil
+	}
+	if os.IsPermission(err) {
+		return fmt.Errorf("permission denied accessing [%s]: %w", dir, err)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if os.IsPermission(err) {
+		return fmt.Errorf("permission denied creating [%s]: %w", dir, err)
+	}
+	return err
+}
+
+func run(ctx context.Context, config *Config, st *State) []*Stat {
+	var p *progress
+	budget, remaining := config.MaxReposPerRun, 0
+	if budget > 0 {
+		var err error
+		p, err = loadProgress(config.progressFile())
+		if err != nil {
+			warnf("Failed to load progress [%s]: %s", config.progressFile(), err)
+			p = &progress{Cursors: map[string]int{}}
+		}
+	}
+	// mu guards claimed, budget, remaining and p, which are shared by the
+	// sources running at once.
+	var mu sync.Mutex
+	// claimed maps the local paths and remotes of the repos already selected
+	// to their source, so a repo listed by several sources is processed
+	// once.
+	claimed := map[string]*Source{}
+	// Failure counts and denied access only skip repos while the config,
+	// tokens included, is the one they were recorded with.
+	sameConfig := !config.force && st != nil && st.ConfigHash == config.hash()
+	skipFailing := config.MaxConsecutiveFailures > 0 && sameConfig
+	runSource := func(source *Source) *Stat {
+		stat := &Stat{
+			Source:     source,
+			Started:    time.Now(),
+			checkpoint: config.checkpoint,
+		}
+		activityAfter := time.Time{}
+		if config.IncrementalAfterFirstRun && st != nil && source.kind() == "gitlab" && !source.AtomicGeneration {
+			if ss := st.Sources[source.String()]; ss != nil && !ss.LastComplete.IsZero() {
+				activityAfter = ss.LastComplete
+				stat.Incremental = true
+				debugf("Listing repos of source [%s] with activity after %s", source, ss.LastComplete.Format(time.RFC3339))
+			}
+		}
+		sourcesMu.Lock()
+		source.activityAfter = activityAfter
+		sourcesMu.Unlock()
+		repos, total, err := getRepo(ctx, config, source)
+		var pe *partialError
+		if errors.As(err, &pe) {
+			warnf("Source [%s] discovery incomplete, processing the %d repos listed. error:'%s'", source, len(repos), err)
+			stat.DiscoveryIncomplete = true
+			err = nil
+		}
+		if err == nil && config.needsIDs() {
+			err = missingID(repos)
+		}
+		if err != nil {
+			warnf("Failed to get source [%s] repos. error:'%s'", source, err)
+			stat.DiscoveryFailed = true
+			stat.Finished = time.Now()
+			return stat
+		}
+		stat.Repos = repos
+		stat.Total = total
+		infof("Found %d repos for source [%s]", len(repos), source)
+		if len(repos) == 0 && !stat.Incremental {
+			if source.failOnEmpty(config) {
+				errorf("Source [%s] returned no repos, check its token and domain", source)
+				stat.Empty = true
+			} else {
+				warnf("Source [%s] returned no repos", source)
+			}
+		}
+		if total > 0 && len(repos) < total*9/10 {
+			warnf("Source [%s] reported %d repos but only %d were listed, pagination may have been truncated", source, total, len(repos))
+		}
+		if config.Probe && !config.DryRun {
+			err := probe(source, repos)
+			if err != nil {
+				warnf("Source [%s] is unreachable, skipping all %d repos. error:'%s'", source, len(repos), err)
+				stat.Unreachable = true
+				stat.Skipped += len(repos)
+				stat.Finished = time.Now()
+				return stat
+			}
+		}
+		var gen *generation
+		if source.AtomicGeneration && !config.DryRun {
+			gen, err = stage(config, source)
+			if err != nil {
+				warnf("Failed to stage generation for source [%s], skipping. error:'%s'", source, err)
+				stat.Failed += len(repos)
+				stat.Finished = time.Now()
+				return stat
+			}
+		}
+		if p != nil {
+			sort.SliceStable(repos, func(i, j int) bool { return repos[i].ID < repos[j].ID })
+		}
+		deferred, resumed := 0, 0
+		var selected []*Repo
+		mu.Lock()
+		for _, repo := range repos {
+			if !skip(source, repo) {
+				local, remote := localPath(config, source, repo), source.remote(repo)
+				if other := claimed[local]; other != nil {
+					infof("Skipped [%s] of source [%s]: duplicate of source [%s] at [%s]", repo.PathWithNamespace, source, other, local)
+					stat.Skipped++
+					continue
+				}
+				if other := claimed[remote]; other != nil {
+					infof("Skipped [%s] of source [%s]: duplicate of source [%s] for [%s]", repo.PathWithNamespace, source, other, remote)
+					stat.Skipped++
+					continue
+				}
+				claimed[local], claimed[remote] = source, source
+				if ss := st.source(source); sameConfig && ss != nil && ss.Repos[repo.PathWithNamespace] != nil && ss.Repos[repo.PathWithNamespace].NoAccess {
+					debugf("Skipped [%s] of source [%s]: access denied in an earlier run", repo.PathWithNamespace, source)
+					stat.SkippedNoAccess++
+					continue
+				}
+				if ss := st.source(source); skipFailing && ss != nil && ss.Repos[repo.PathWithNamespace] != nil {
+					if n := ss.Repos[repo.PathWithNamespace].ConsecutiveFailures; n >= config.MaxConsecutiveFailures {
+						warnf("Skipped [%s] of source [%s]: failed %d runs in a row, last error:'%s'", repo.PathWithNamespace, source, n, ss.Repos[repo.PathWithNamespace].LastError)
+						stat.SkippedFailing++
+						continue
+					}
+				}
+				if config.resume && config.checkpoint.done(source, repo) {
+					resumed++
+					continue
+				}
+			}
+			if p != nil && !skip(source, repo) {
+				if repo.ID <= p.Cursors[source.String()] {
+					continue
+				}
+				if budget <= 0 {
+					deferred++
+					continue
+				}
+				budget--
+				p.Cursors[source.String()] = repo.ID
+			}
+			selected = append(selected, repo)
+		}
+		mu.Unlock()
+		if resumed > 0 {
+			infof("Skipped %d repos of source [%s] completed before the run was interrupted", resumed, source)
+			stat.Skipped += resumed
+		}
+		var moved map[int]string
+		if !config.DryRun {
+			moved = movedMirrors(config, source, st.source(source), repos)
+		}
+		sourcesMu.Lock()
+		source.moved = moved
+		sourcesMu.Unlock()
+		work(ctx, config, source, stat, selected)
+		stat.Slowest = slowest(stat, config.slowestRepos())
+		if source.Prune && !stat.Incremental && !stat.DiscoveryIncomplete {
+			prune(config, source, stat, repos)
+		}
+		if p != nil {
+			mu.Lock()
+			if deferred == 0 {
+				delete(p.Cursors, source.String())
+			}
+			remaining += deferred
+			mu.Unlock()
+		}
+		complete := deferred == 0 && !halted(ctx) && !stat.DiscoveryIncomplete
+		if gen != nil {
+			gen.finish(source, stat, complete)
+		}
+		stat.Complete = complete
+		stat.Finished = time.Now()
+		return stat
+	}
+
+	// Sources run SourceConcurrency at a time, those on the same domain one
+	// after another in config order. Each stat is stored at the index of its
+	// source, so the stats keep the config order whatever order the sources
+	// finish in.
+	started := make([]*Stat, len(config.Sources))
+	running := make(chan struct{}, config.sourceConcurrency())
+	var wg sync.WaitGroup
+	for _, group := range sourceGroups(config) {
+		running <- struct{}{}
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			defer func() { <-running }()
+			finished := map[string]time.Time{}
+			for _, i := range group {
+				source := config.Sources[i]
+				if halted(ctx) {
+					return
+				}
+				cooldown(ctx, config, source, finished[source.Domain])
+				if halted(ctx) {
+					return
+				}
+				started[i] = runSource(source)
+				finished[source.Domain] = started[i].Finished
+			}
+		}(group)
+	}
+	wg.Wait()
+	var stats []*Stat
+	for _, stat := range started {
+		if stat != nil {
+			stats = append(stats, stat)
+		}
+	}
+	if p != nil {
+		infof("%d repos remain for the next run (max_repos_per_run:%d)", remaining, config.MaxReposPerRun)
+		if !config.DryRun && !halted(ctx) {
+			err := p.save(config.progressFile())
+			if err != nil {
+				warnf("Failed to save progress [%s]: %s", config.progressFile(), err)
+			}
+		}
+	}
+	for _, stat := range stats {
+		infof("Source [%s] stats: repos:%d skipped:%d skipped_no_access:%d skipped_archived:%d skipped_empty:%d skipped_topic:%d skipped_too_large:%d skipped_failing:%d mirrored:%d updated:%d moved:%d failed:%d failed_mirror:%d failed_update:%d failed_too_big:%d rejected_host:%d failed_lfs:%d wikis:%d failed_wiki:%d pushed:%d failed_push:%d bundles:%d failed_bundle:%d uploaded:%d failed_upload:%d gced:%d optimized:%d partial_updated:%d drifted:%d releases:%d snippets:%d metadata:%d pruned:%d", stat.Source, len(stat.Repos), stat.Skipped, stat.SkippedNoAccess, stat.SkippedArchived, stat.SkippedEmpty, stat.SkippedTopic, stat.SkippedTooLarge, stat.SkippedFailing, stat.Mirrored, stat.Updated, stat.Moved, stat.Failed, stat.FailedMirror, stat.FailedUpdate, stat.FailedTooBig, stat.RejectedHost, stat.FailedLFS, stat.Wikis, stat.FailedWiki, stat.Pushed, stat.FailedPush, stat.Bundles, stat.FailedBundle, stat.Uploaded, stat.FailedUpload, stat.GCed, stat.Optimized, stat.PartialUpdated, stat.Drifted, stat.Releases, stat.Snippets, stat.Metadata, stat.Pruned)
+		logSlowest(stat)
+		if stat.SkippedNoAccess > 0 {
+			infof("Source [%s]: the token cannot access %d repos", stat.Source, stat.SkippedNoAccess)
+		}
+		if len(stat.FailureReasons) > 0 {
+			infof("Source [%s] failures by reason: %s", stat.Source, failureSummary(stat.FailureReasons))
+		}
+		if len(stat.Changed) > 0 {
+			infof("Source [%s] changed repos: %s", stat.Source, strings.Join(stat.Changed, ", "))
+		}
+	}
+	return stats
+}
+
+// sourceGroups returns the indexes of config.Sources in groups that run
+// concurrently: a single group in config order when SourceConcurrency is 1,
+// otherwise one group per domain.
+func sourceGroups(config *Config) [][]int {
+	if config.sourceConcurrency() == 1 {
+		group := make([]int, len(config.Sources))
+		for i := range group {
+			group[i] = i
+		}
+		return [][]int{group}
+	}
+	var groups [][]int
+	index := map[string]int{}
+	for i, source := range config.Sources {
+		g, ok := index[source.Domain]
+		if !ok {
+			g = len(groups)
+			index[source.Domain] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// cooldown waits out the rest of SourceCooldown since last, when the
+// previous source on the domain of source finished.
+func cooldown(ctx context.Context, config *Config, source *Source, last time.Time) {
+	if config.SourceCooldown <= 0 || last.IsZero() {
+		return
+	}
+	d := time.Until(last.Add(time.Duration(config.SourceCooldown)))
+	if d <= 0 {
+		return
+	}
+	infof("Cooling down %s before source [%s] on domain [%s]", d.Round(time.Millisecond), source, source.Domain)
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// work processes repos with up to Source.Concurrency workers, each holding
+// a slot of the source's limiter, a per-source and a global slot while it
+// processes a repo. They are taken in that order so a throttled source
+// holds no global slot idle. Each repo is processed against its own Stat
+// which is then merged into stat, so the per-repo code never shares
+// counters between workers.
+func work(ctx context.Context, config *Config, source *Source, stat *Stat, repos []*Repo) {
+	concurrency := source.concurrency(config)
+	global, perSource := globalSlots(config), sourceSlots(config, source)
+	l := limiterFor(source)
+	l.setMax(concurrency)
+	started := time.Now()
+	var done int64
+	var hb *heartbeat
+	if config.heartbeat {
+		hb = startHeartbeat(source, len(repos))
+		defer hb.finish()
+	}
+	var wg sync.WaitGroup
+	ch := make(chan *Repo, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repo := range ch {
+				if halted(ctx) {
+					continue
+				}
+				waitLoad(ctx, config)
+				if halted(ctx) {
+					continue
+				}
+				l.acquire(ctx)
+				perSource <- struct{}{}
+				global <- struct{}{}
+				s := &Stat{Source: source}
+				unlock := lockRepo(localPath(config, source, repo))
+				safeProcess(ctx, config, source, s, repo)
+				unlock()
+				<-global
+				<-perSource
+				l.release()
+				stat.add(repo, s)
+				hb.observe(s)
+				if s.Failed+s.FailedMirror+s.FailedUpdate == 0 && !halted(ctx) {
+					stat.checkpoint.mark(source, repo)
+				}
+				if n := int(atomic.AddInt64(&done, 1)); n%10 == 0 || n == len(repos) {
+					elapsed := time.Since(started)
+					eta := time.Duration(float64(elapsed) / float64(n) * float64(len(repos)-n))
+					infof("Progress [%s]: %d/%d (%.1f%%) elapsed:%s eta:%s", source, n, len(repos), float64(n)*100/float64(len(repos)), elapsed.Round(time.Second), eta.Round(time.Second))
+				}
+				if config.DelayBetweenRepos > 0 {
+					time.Sleep(time.Duration(config.DelayBetweenRepos))
+				}
+			}
+		}()
+	}
+	for _, repo := range repos {
+		if halted(ctx) {
+			break
+		}
+		ch <- repo
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// safeProcess runs process and turns a panic into a failure of that repo so
+// the rest of the run continues.
+func safeProcess(ctx context.Context, config *Config, source *Source, stat *Stat, repo *Repo) {
+	defer func() {
+		if r := recover(); r != nil {
+			warnf("Failed [%s]: panic:'%v'\n%s", repo.PathWithNamespace, r, debug.Stack())
+			stat.Error = fmt.Sprintf("panic:'%v'", r)
+			stat.Failed++
+		}
+	}()
+	process(ctx, config, source, stat, repo)
+}
+
+func process(ctx context.Context, config *Config, source *Source, stat *Stat, repo *Repo) {
+	config, source = effective(config, source, repo)
+	remote := source.remote(repo)
+	local := localPath(config, source, repo)
+	if skip(source, repo) {
+		switch {
+		case archived(source, repo):
+			stat.SkippedArchived++
+		case repo.EmptyRepo:
+			debugf("Skipped [%s]: empty repository", repo.PathWithNamespace)
+			stat.SkippedEmpty++
+		case topicReason(source, repo) != "":
+			debugf("Skipped [%s]: %s", repo.PathWithNamespace, topicReason(source, repo))
+			stat.SkippedTopic++
+		default:
+			stat.Skipped++
+		}
+		return
+	}
+	if reason := hostReason(source, remote); reason != "" {
+		warnf("Rejected [%s] of source [%s]: %s", repo.PathWithNamespace, source, reason)
+		stat.RejectedHost++
+		return
+	}
+	if config.DryRun {
+		wouldProcess(ctx, source, stat, repo, local)
+		return
+	}
+	stat.local = local
+	var w io.Writer
+	repoLog, err := repoLogWriter(config, source, repo)
+	if err != nil {
+		warnf("Failed to open repo log for [%s]: %s", local, err)
+	} else if repoLog != nil {
+		defer repoLog.Close()
+		w = repoLog
+	}
+	_, err = os.Stat(local)
+	if os.IsNotExist(err) && move(source, repo, remote, local, w) {
+		stat.Moved++
+		_, err = os.Stat(local)
+	}
+	if err == nil && !valid(local) {
+		warnf("Mirror [%s] is not a valid repository, probably from an interrupted clone, re-mirroring", local)
+		err = remove(local)
+		if err != nil {
+			stat.failf("Failed to remove invalid mirror [%s]: %s", local, err)
+			stat.Failed++
+			return
+		}
+		_, err = os.Stat(local)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			stat.failf("Failed to stat [%s]: %s", local, err)
+			stat.Failed++
+			return
+		}
+		if tooLarge(source, repo) {
+			infof("Skipped mirror [%s] -> [%s]: repository size %d exceeds MaxRepoSize %d", remote, local, repo.Statistics.RepositorySize, source.MaxRepoSize)
+			stat.SkippedTooLarge++
+			return
+		}
+		if config.MinFreeSpace > 0 {
+			free, err := freeSpace(existingParent(local))
+			if err != nil {
+				warnf("Failed to check free space for [%s]: %s", local, err)
+			} else if free < int64(config.MinFreeSpace) {
+				stat.failf("Failed mirror [%s] -> [%s]: insufficient disk space, %d bytes free, MinFreeSpace %d", remote, local, free, config.MinFreeSpace)
+				stat.FailedMirror++
+				if config.StopOnLowDisk {
+					warnf("Stopping the run, destination is low on disk space")
+					stop()
+				}
+				return
+			}
+		}
+		url := remote
+		tmp := tempPath(local)
+		debugf("Mirroring [%s] -> [%s]", remote, local)
+		cloneStarted := time.Now()
+		err := retry(ctx, config, fmt.Sprintf("clone [%s]", remote), network, func() error {
+			cctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+			defer cancel()
+			_, err := clone(cctx, url, tmp, source.bare(), source.Depth, "", source.refspecs(), auth(source, url), w)
+			if err != nil {
+				remove(tmp)
+			}
+			return err
+		})
+		if err != nil && tooBig(err) && config.PartialCloneFallback && source.Depth == 0 && ctx.Err() == nil {
+			warnf("Clone [%s] failed as too big, retrying as partial clone: %s", remote, err)
+			cctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+			_, err = clone(cctx, url, tmp, source.bare(), 0, "blob:none", source.refspecs(), auth(source, url), w)
+			cancel()
+			if err != nil {
+				remove(tmp)
+			}
+		}
+		stat.cloneTime = time.Since(cloneStarted)
+		metrics.observe("clone", stat.cloneTime)
+		if err != nil {
+			if denied(err) {
+				warnf("Skipped mirror [%s] -> [%s]: access denied, the token cannot read this repo. It is skipped until the config changes or -force", remote, local)
+				cleanup(tmp)
+				stat.SkippedNoAccess++
+				stat.noAccess = true
+				return
+			}
+			stat.failf("Failed mirror [%s] -> [%s]: clone error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			if tooBig(err) {
+				stat.FailedTooBig++
+			}
+			return
+		}
+		_, err = disablegc(tmp, w)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: disablegc error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		_, err = pruneconfig(tmp, source.pruneRefs(config), w)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: pruneconfig error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		if config.FsckOnFetch {
+			_, err = fsckconfig(tmp, w)
+			if err != nil {
+				stat.failf("Failed mirror [%s] -> [%s]: fsckconfig error:'%s'", remote, local, err)
+				cleanup(tmp)
+				stat.FailedMirror++
+				return
+			}
+		}
+		_, err = describe(tmp, remote, repo, w)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: describe error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		if config.keepEmptyDirs() {
+			err = touch(tmp)
+			if err != nil {
+				stat.failf("Failed mirror [%s] -> [%s]: touch error:'%s'", remote, local, err)
+				cleanup(tmp)
+				stat.FailedMirror++
+				return
+			}
+		}
+		largestsize, loose, err := objects(tmp)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: objects error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		if largestsize > config.repackThreshold() || tooLoose(config, loose) {
+			debugf("Should repack [%s]. objects largestsize=%d loose=%d", local, largestsize, loose)
+			cctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+			repackStarted := time.Now()
+			_, err = repack(cctx, tmp, config.maxPackSize(), w)
+			stat.repackTime = time.Since(repackStarted)
+			cancel()
+			if err != nil {
+				stat.failf("Failed mirror [%s] -> [%s]: repack error:'%s'", remote, local, err)
+				cleanup(tmp)
+				stat.FailedMirror++
+				return
+			}
+			debugf("Repack [%s] finished.", local)
+		}
+		updateStarted := time.Now()
+		err = retry(ctx, config, fmt.Sprintf("update [%s]", remote), network, func() error {
+			uctx, cancel := context.WithTimeout(ctx, config.updateTimeout())
+			defer cancel()
+			_, err := refresh(uctx, source, remote, tmp, source.pruneRefs(config), w)
+			return err
+		})
+		stat.updateTime = time.Since(updateStarted)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]. update error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		count, err := refs(tmp)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: refs error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		if count == 0 && repo.DefaultBranch != "" {
+			stat.failf("Failed mirror [%s] -> [%s]: clone produced no refs but upstream has default branch '%s'", remote, local, repo.DefaultBranch)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		if config.Verify {
+			_, err = fsck(tmp, w)
+			if err != nil {
+				stat.failf("Failed mirror [%s] -> [%s]: fsck error:'%s'", remote, local, err)
+				cleanup(tmp)
+				stat.FailedMirror++
+				return
+			}
+		}
+		if source.bare() {
+			_, err = sethead(tmp, repo.DefaultBranch, w)
+			if err != nil {
+				warnf("Failed to set HEAD of [%s] to '%s': %s", local, repo.DefaultBranch, err)
+			}
+		}
+		err = os.Rename(tmp, local)
+		if err != nil {
+			stat.failf("Failed mirror [%s] -> [%s]: rename error:'%s'", remote, local, err)
+			cleanup(tmp)
+			stat.FailedMirror++
+			return
+		}
+		infof("Successfully mirror [%s] -> [%s]", remote, local)
+		if source.LFS {
+			fetchLFS(ctx, config, source, stat, remote, local, w)
+		}
+		if source.Wikis {
+			mirrorWiki(ctx, config, source, stat, repo, remote, local, w)
+		}
+		if config.PushTo != nil && source.bare() {
+			pushMirror(ctx, config, stat, repo, local, w)
+		}
+		if config.Layout == "id" {
+			link(config, source, repo, local, w)
+		}
+		if source.FetchReleases {
+			stat.Releases += releases(ctx, source, repo, local)
+		}
+		if source.Snippets {
+			stat.Snippets += snippets(ctx, source, repo, local)
+		}
+		if source.Metadata && metadata(ctx, config, source, repo, local) {
+			stat.Metadata++
+		}
+		optimize(ctx, config, stat, local, w)
+		if config.Bundle {
+			writeBundle(ctx, config, source, stat, repo, local, true, w)
+		}
+		stat.Mirrored++
+		stat.Changed = append(stat.Changed, repo.PathWithNamespace)
+	} else {
+		if source.NoUpdate {
+			debugf("Skipped update [%s] -> [%s]: NoUpdate", remote, local)
+			stat.Skipped++
+			return
+		}
+		if inactive(source, repo) {
+			stat.Skipped++
+			return
+		}
+		if tooLarge(source, repo) {
+			warnf("Mirror [%s] repository size %d exceeds MaxRepoSize %d", local, repo.Statistics.RepositorySize, source.MaxRepoSize)
+		}
+		if source.CommitWithinDays > 0 {
+			last, err := lastCommit(ctx, source, repo)
+			if err != nil {
+				warnf("Failed to get last commit of [%s]: %s", remote, err)
+			} else if !last.IsZero() && time.Since(last) > time.Duration(source.CommitWithinDays)*24*time.Hour {
+				stat.Skipped++
+				return
+			}
+		}
+		debugf("Updating [%s] -> [%s]", remote, local)
+		before, err := tips(local)
+		if err != nil {
+			warnf("Failed to read ref tips of [%s]: %s", local, err)
+		}
+		_, err = disablegc(local, w)
+		if err != nil {
+			stat.failf("Failed update [%s] -> [%s]: disablegc error:'%s'", remote, local, err)
+			stat.FailedUpdate++
+			return
+		}
+		_, err = pruneconfig(local, source.pruneRefs(config), w)
+		if err != nil {
+			stat.failf("Failed update [%s] -> [%s]: pruneconfig error:'%s'", remote, local, err)
+			stat.FailedUpdate++
+			return
+		}
+		if config.TouchOnUpdate && config.keepEmptyDirs() {
+			err = touch(local)
+			if err != nil {
+				stat.failf("Failed update [%s] -> [%s]: touch error:'%s'", remote, local, err)
+				stat.FailedUpdate++
+				return
+			}
+		}
+		updateStarted := time.Now()
+		err = retry(ctx, config, fmt.Sprintf("update [%s]", remote), network, func() error {
+			uctx, cancel := context.WithTimeout(ctx, config.updateTimeout())
+			defer cancel()
+			_, err := refresh(uctx, source, remote, local, source.pruneRefs(config), w)
+			return err
+		})
+		stat.updateTime = time.Since(updateStarted)
+		metrics.observe("update", stat.updateTime)
+		if err != nil {
+			if denied(err) {
+				warnf("Skipped update [%s] -> [%s]: access denied, the token cannot read this repo. It is skipped until the config changes or -force", remote, local)
+				stat.SkippedNoAccess++
+				stat.noAccess = true
+				return
+			}
+			if network(err) {
+				if _, ferr := fsck(local, w); ferr == nil {
+					warnf("Partially update [%s] -> [%s]: fetch interrupted but mirror is consistent, next run will complete it. error: %s", remote, local, err)
+					stat.PartialUpdated++
+					return
+				}
+				stat.failf("Failed update [%s] -> [%s]: fetch interrupted and mirror failed fsck. error: %s", remote, local, err)
+				stat.FailedUpdate++
+				return
+			}
+			stat.failf("Failed update [%s] -> [%s] error: %s", remote, local, err)
+			stat.FailedUpdate++
+			return
+		}
+		if config.VerifyUpdates {
+			_, err = fsck(local, w)
+			if err != nil {
+				stat.failf("Failed update [%s] -> [%s]: fsck error:'%s'", remote, local, err)
+				stat.FailedUpdate++
+				return
+			}
+		}
+		isdrifted, err := drifted(local)
+		if err != nil {
+			warnf("Failed check drift [%s]: %s", local, err)
+		} else if isdrifted {
+			warnf("Mirror [%s] has drifted into an inconsistent shallow/partial state and needs re-clone", local)
+			stat.Drifted++
+		}
+		if source.bare() {
+			_, err = sethead(local, repo.DefaultBranch, w)
+			if err != nil {
+				warnf("Failed to set HEAD of [%s] to '%s': %s", local, repo.DefaultBranch, err)
+			}
+		}
+		infof("Successfully update [%s] -> [%s]", remote, local)
+		if source.LFS {
+			fetchLFS(ctx, config, source, stat, remote, local, w)
+		}
+		if source.Wikis {
+			mirrorWiki(ctx, config, source, stat, repo, remote, local, w)
+		}
+		if config.PushTo != nil && source.bare() {
+			pushMirror(ctx, config, stat, repo, local, w)
+		}
+		if config.Layout == "id" {
+			link(config, source, repo, local, w)
+		}
+		if source.FetchReleases {
+			stat.Releases += releases(ctx, source, repo, local)
+		}
+		if source.Snippets {
+			stat.Snippets += snippets(ctx, source, repo, local)
+		}
+		if source.Metadata && metadata(ctx, config, source, repo, local) {
+			stat.Metadata++
+		}
+		repackLoose(ctx, config, stat, local, w)
+		maintain(ctx, config, stat, local, w)
+		optimize(ctx, config, stat, local, w)
+		after, err := tips(local)
+		changed := err != nil || after != before
+		if config.Bundle {
+			writeBundle(ctx, config, source, stat, repo, local, changed, w)
+		}
+		stat.Updated++
+		if changed {
+			stat.Changed = append(stat.Changed, repo.PathWithNamespace)
+		}
+	}
+}
+
+// wouldProcess logs and counts what process would do for repo without
+// touching local.
+func wouldProcess(ctx context.Context, source *Source, stat *Stat, repo *Repo, local string) {
+	remote := source.remote(repo)
+	_, err := os.Stat(local)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warnf("Failed to stat [%s]: %s", local, err)
+			stat.Failed++
+			return
+		}
+		if tooLarge(source, repo) {
+			infof("Would skip mirror [%s] -> [%s]: repository size %d exceeds MaxRepoSize %d", remote, local, repo.Statistics.RepositorySize, source.MaxRepoSize)
+			stat.SkippedTooLarge++
+			return
+		}
+		infof("Would mirror [%s] -> [%s]", remote, local)
+		stat.Mirrored++
+		stat.Changed = append(stat.Changed, repo.PathWithNamespace)
+		return
+	}
+	if inactive(source, repo) {
+		stat.Skipped++
+		return
+	}
+	if source.CommitWithinDays > 0 {
+		last, err := lastCommit(ctx, source, repo)
+		if err != nil {
+			warnf("Failed to get last commit of [%s]: %s", remote, err)
+		} else if !last.IsZero() && time.Since(last) > time.Duration(source.CommitWithinDays)*24*time.Hour {
+			stat.Skipped++
+			return
+		}
+	}
+	infof("Would update [%s] -> [%s]", remote, local)
+	stat.Updated++
+}
+
+// tooLarge reports whether repo is larger than Source.MaxRepoSize. Repos
+// whose size the API did not report are never too large.
+func tooLarge(source *Source, repo *Repo) bool {
+	return source.MaxRepoSize > 0 && repo.Statistics.RepositorySize > int64(source.MaxRepoSize)
+}
+
+// inactive reports whether repo had no activity within Source.UpdatedSince.
+func inactive(source *Source, repo *Repo) bool {
+	return source.UpdatedSince > 0 && !repo.LastActivityAt.IsZero() && time.Since(repo.LastActivityAt) > time.Duration(source.UpdatedSince)
+}
+
+// exitCode returns the exit code of a run from its stats. Failed repos only
+// fail the run once there are more than Config.MaxFailures of them.
+func exitCode(config *Config, stats []*Stat) int {
+	code := ExitOK
+	discoveryFailed, failed := 0, 0
+	for _, stat := range stats {
+		if stat.DiscoveryFailed {
+			discoveryFailed++
+		}
+		if stat.DiscoveryIncomplete || stat.Empty {
+			code = ExitFailed
+		}
+		failed += stat.Failed + stat.FailedMirror + stat.FailedUpdate
+	}
+	if len(stats) > 0 && discoveryFailed == len(stats) {
+		return ExitAllSourcesFailed
+	}
+	if discoveryFailed > 0 {
+		return ExitDiscoveryFailed
+	}
+	if failed > config.MaxFailures {
+		return ExitFailed
+	}
+	if failed > 0 {
+		warnf("%d repos failed, within MaxFailures %d", failed, config.MaxFailures)
+	}
+	return code
+}
+
+// configFiles are the config files looked up in the working directory when
+// no explicit path is given, in order of preference.
+var configFiles = []string{"config.json", "config.yaml", "config.yml"}
+
+// loadConfig reads the config from file, or from the first of configFiles
+// that exists when file is empty. The format is detected by extension. file
+// may also be a comma-separated list of files and directories, the .json,
+// .yaml and .yml files of a directory being read in name order; later files
+// are overlaid on earlier ones as described at readConfig.
+func loadConfig(file string) (*Config, error) {
+	if file == "" {
+		var found []string
+		for _, name := range configFiles {
+			if _, err := os.Stat(name); err == nil {
+				found = append(found, name)
+			}
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no config file found, tried %s", strings.Join(configFiles, ", "))
+		}
+		if len(found) > 1 {
+			infof("Multiple config files found %v, using [%s]", found, found[0])
+		}
+		file = found[0]
+	}
+	files, err := configPaths(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	for _, file := range files {
+		err = readConfig(file, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = applyEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range config.Sources {
+		source.Token, err = resolveToken(source.Token)
+		if err != nil {
+			return nil, fmt.Errorf("source [%s] token: %w", source, err)
+		}
+		if source.Domain == "" && source.APIBaseURL != "" {
+			u, err := neturl.Parse(source.APIBaseURL)
+			if err != nil {
+				return nil, fmt.Errorf("source APIBaseURL '%s': %w", source.APIBaseURL, err)
+			}
+			source.Domain = strings.Trim(u.Host+u.Path, "/")
+		}
+	}
+	if config.PushTo != nil {
+		config.PushTo.Token, err = resolveToken(config.PushTo.Token)
+		if err != nil {
+			return nil, fmt.Errorf("PushTo token: %w", err)
+		}
+	}
+	if config.PerPage > 100 {
+		warnf("PerPage %d is above GitLab's maximum, using 100", config.PerPage)
+	}
+	return config, nil
+}
+
+// configPaths expands the comma-separated list of config files and
+// directories in file.
+func configPaths(file string) ([]string, error) {
+	var files []string
+	for _, name := range strings.Split(file, ",") {
+		name = strings.TrimSpace(name)
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		n := len(files)
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".json", ".yaml", ".yml":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(name, e.Name()))
+				}
+			}
+		}
+		if len(files) == n {
+			return nil, fmt.Errorf("no config files in directory [%s]", name)
+		}
+	}
+	return files, nil
+}
+
+// readConfig overlays file on config. Scalar fields and lists other than
+// Sources that are present in file replace the earlier values, and fields
+// it leaves out keep them. Sources are appended, except that a source with
+// the same Domain and Username as an earlier one replaces it in place.
+func readConfig(file string, config *Config) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sources := config.Sources
+	config.Sources = nil
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, config)
+	default:
+		err = json.Unmarshal(b, config)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, source := range config.Sources {
+		replaced := false
+		for i, prev := range sources {
+			if prev.Domain == source.Domain && prev.Username == source.Username {
+				sources[i], replaced = source, true
+				break
+			}
+		}
+		if !replaced {
+			sources = append(sources, source)
+		}
+	}
+	config.Sources = sources
+	return nil
+}
+
+// resolveToken returns the token a config value refers to: env:NAME reads
+// the environment variable NAME and file:PATH the trimmed contents of PATH.
+// Any other value is a literal token.
+func resolveToken(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "env:"):
+		name := strings.TrimPrefix(v, "env:")
+		token, ok := os.LookupEnv(name)
+		if !ok || token == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return token, nil
+	case strings.HasPrefix(v, "file:"):
+		b, err := os.ReadFile(strings.TrimPrefix(v, "file:"))
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", strings.TrimPrefix(v, "file:"))
+		}
+		return token, nil
+	}
+	return v, nil
+}
+
+type Repo struct {
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	NameWithNamespace string    `json:"name_with_namespace"`
+	Path              string    `json:"path"`
+	PathWithNamespace string    `json:"path_with_namespace"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastActivityAt    time.Time `json:"last_activity_at"`
+	Archived          bool      `json:"archived"`
+	WikiEnabled       bool      `json:"wiki_enabled"`
+	Statistics        struct {
+		RepositorySize int64 `json:"repository_size"`
+	} `json:"statistics"`
+	Visibility    string    `json:"visibility"`
+	HTTPURLToRepo string    `json:"http_url_to_repo"`
+	SSHURLToRepo  string    `json:"ssh_url_to_repo"`
+	Description   string    `json:"description"`
+	DefaultBranch string    `json:"default_branch"`
+	Namespace     Namespace `json:"namespace"`
+	Topics        []string  `json:"topics"`
+	// Language is the primary language, only looked up for sources with
+	// language filters.
+	Language string `json:"language"`
+	// EmptyRepo is set by GitLab for projects without any commits. They
+	// are skipped until their first push since there is nothing to mirror.
+	EmptyRepo bool `json:"empty_repo"`
+}
+
+type Namespace struct {
+	ID       int    `json:"id"`
+	FullPath string `json:"full_path"`
+}
+
+// gitlab lists repos through the GitLab v4 projects API.
+type gitlab struct{}
+
+// List lists the projects of each of Source.Groups including subgroups, or
+// every project visible to the token when no groups are set.
+func (g gitlab) List(ctx context.Context, config *Config, source *Source) ([]*Repo, int, error) {
+	groups := source.Groups
+	if len(groups) == 0 && source.AutoGroups {
+		var err error
+		groups, err = g.groups(ctx, config, source)
+		if err != nil {
+			return nil, 0, fmt.Errorf("groups: %w", err)
+		}
+		if len(groups) == 0 {
+			infof("Source [%s] token reaches no groups, listing every visible project", source)
+		} else {
+			debugf("Source [%s] discovered groups: %s", source, strings.Join(groups, ", "))
+		}
+	}
+	if len(groups) == 0 {
+		repos, total, err := g.list(ctx, config, source, "")
+		if err != nil && repos == nil {
+			return nil, 0, err
+		}
+		return dedup(source, repos), total, err
+	}
+	var repos []*Repo
+	var partial error
+	total := 0
+	for _, group := range groups {
+		r, t, err := g.list(ctx, config, source, "/groups/"+neturl.PathEscape(strings.Trim(group, "/")))
+		var pe *partialError
+		if errors.As(err, &pe) {
+			partial = &partialError{err: fmt.Errorf("group %s: %w", group, pe.err)}
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("group %s: %w", group, err)
+		}
+		repos = append(repos, r...)
+		total += t
+	}
+	return dedup(source, repos), total, partial
+}
+
+// groups returns the full paths of the groups the token has at least guest
+// access to, leaving out subgroups of other returned groups since those
+// are listed with their parent.
+func (gitlab) groups(ctx context.Context, config *Config, source *Source) ([]string, error) {
+	var paths []string
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/groups?min_access_level=10&order_by=id&sort=asc&page=%d&per_page=100", source.baseURL(), page)
+		var groups []*Namespace
+		err := getJSON(ctx, config, source, fmt.Sprintf("groups page %d", page), url, &groups)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			paths = append(paths, group.FullPath)
+		}
+		if len(groups) < 100 {
+			break
+		}
+	}
+	var top []string
+	for _, path := range paths {
+		if !ingroups(paths, path[:max(strings.LastIndex(path, "/"), 0)]) {
+			top = append(top, path)
+		}
+	}
+	return top, nil
+}
+
+// Get looks up one project by its path with namespace.
+func (gitlab) Get(ctx context.Context, config *Config, source *Source, path string) (*Repo, error) {
+	url := fmt.Sprintf("%s/api/v4/projects/%s", source.baseURL(), neturl.PathEscape(path))
+	if source.MaxRepoSize > 0 {
+		url += "?statistics=true"
+	}
+	repo := &Repo{}
+	err := getJSON(ctx, config, source, "["+path+"]", url, repo)
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// list pages through the projects under scope, "" for the instance-wide
+// listing or /groups/<id> for one group.
+func (gitlab) list(ctx context.Context, config *Config, source *Source, scope string) ([]*Repo, int, error) {
+	var repos []*Repo
+	perPage := config.perPage()
+	url := projectsURL(source, scope, 1, perPage)
+	full := false
+	reported := 0
+	for page := 1; ; page++ {
+		var p *Page
+		fetch := func() (err error) {
+			p, err = getRepoPage(ctx, source, url)
+			return err
+		}
+		err := retryN(ctx, config, config.pageRetries(), fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, fetch)
+		if err != nil {
+			if len(repos) > 0 && transientAPI(err) {
+				return repos, reported, &partialError{err: fmt.Errorf("page %d: %w", page, err)}
+			}
+			return nil, 0, err
+		}
+		if page == 1 {
+			reported = p.Total
+		}
+		for attempt := 1; len(p.Repos) == 0 && full && p.Total > len(repos) && attempt <= config.emptyPageRetries(); attempt++ {
+			infof("Source [%s] page %d returned no repos but total is %d, got %d. retry %d/%d", source, page, p.Total, len(repos), attempt, config.emptyPageRetries())
+			select {
+			case <-ctx.Done():
+				return repos, reported, &partialError{err: ctx.Err()}
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+			err = retryN(ctx, config, config.pageRetries(), fmt.Sprintf("list page %d of [%s]", page, source), transientAPI, fetch)
+			if err != nil {
+				if len(repos) > 0 && transientAPI(err) {
+					return repos, reported, &partialError{err: fmt.Errorf("page %d: %w", page, err)}
+				}
+				return nil, 0, err
+			}
+		}
+		if len(p.Repos) == 0 {
+			break
+		}
+		repos = append(repos, p.Repos...)
+		full = len(p.Repos) == perPage
+		if p.Linked {
+			if p.Next == "" {
+				break
+			}
+			url = p.Next
+			continue
+		}
+		url = projectsURL(source, scope, page+1, perPage)
+	}
+	return repos, reported, nil
+}
+
+func dedup(source *Source, repos []*Repo) []*Repo {
+	seen := make(map[string]bool, len(repos))
+	unique := repos[:0]
+	for _, repo := range repos {
+		key := strconv.Itoa(repo.ID)
+		if repo.ID == 0 {
+			key = repo.PathWithNamespace
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, repo)
+	}
+	if n := len(repos) - len(unique); n > 0 {
+		infof("Source [%s] returned %d duplicate repos, listing may have raced with project creation", source, n)
+	}
+	return unique
+}
+
+// listCommand runs Source.ListCommand, which must print a JSON array of
+// repos in the same shape as the GitLab projects API on stdout.
+func listCommand(ctx context.Context, source *Source) ([]*Repo, error) {
+	cmd := exec.CommandContext(ctx, source.ListCommand[0], source.ListCommand[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("list command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var repos []*Repo
+	err = json.Unmarshal(out, &repos)
+	if err != nil {
+		return nil, fmt.Errorf("list command printed invalid repo JSON: %w", err)
+	}
+	for i, repo := range repos {
+		if repo == nil || repo.HTTPURLToRepo == "" || repo.PathWithNamespace == "" {
+			return nil, fmt.Errorf("list command repo %d is missing http_url_to_repo or path_with_namespace", i)
+		}
+	}
+	return dedup(source, repos), nil
+}
+
+// Page is one page of the projects API. Linked is set when the response
+// carried a Link header, in which case Next is the rel="next" URL or empty
+// on the last page.
+type Page struct {
+	Repos  []*Repo
+	Total  int
+	Next   string
+	Linked bool
+}
+
+func projectsURL(source *Source, scope string, page, perPage int) string {
+	url := fmt.Sprintf("%s/api/v4%s/projects?page=%d&per_page=%d&order_by=id&sort=asc", source.baseURL(), scope, page, perPage)
+	if scope != "" {
+		url += "&include_subgroups=true"
+	} else if source.Membership {
+		url += "&membership=true"
+	}
+	if source.Owned {
+		url += "&owned=true"
+	}
+	if source.MaxRepoSize > 0 {
+		url += "&statistics=true"
+	}
+	if !source.activityAfter.IsZero() {
+		url += "&last_activity_after=" + neturl.QueryEscape(source.activityAfter.UTC().Format(time.RFC3339))
+	}
+	return url
+}
+
+func getRepoPage(ctx context.Context, source *Source, url string) (*Page, error) {
+	resp, err := apiGet(ctx, source, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = checkStatus(source, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Page{}
+	err = json.NewDecoder(resp.Body).Decode(&p.Repos)
+	if err != nil {
+		return nil, err
+	}
+	p.Total, _ = strconv.Atoi(resp.Header.Get("X-Total"))
+	if link := resp.Header.Get("Link"); link != "" {
+		p.Linked = true
+		p.Next = nextLink(link)
+	}
+	return p, nil
+}
+
+// nextLink returns the rel="next" URL of a Link header, or "".
+func nextLink(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		segments := strings.Split(part, ";")
+		if len(segments) < 2 {
+			continue
+		}
+		for _, param := range segments[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(segments[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+func apiGet(ctx context.Context, source *Source, url string) (*http.Response, error) {
+	return apiDo(ctx, source, "GET", url, nil)
+}
+
+// apiDo sends an API request, with form as the url-encoded body if set.
+func apiDo(ctx context.Context, source *Source, method, url string, form neturl.Values) (*http.Response, error) {
+	return apiSend(ctx, source, method, url, form, false)
+}
+
+// apiDownload is apiGet without APITimeout, so large downloads such as
+// release assets are not cut off. Release asset links may point at any
+// host, so the token is only sent when url is on the source's own host.
+func apiDownload(ctx context.Context, source *Source, url string) (*http.Response, error) {
+	return apiSend(ctx, source, "GET", url, nil, true)
+}
+
+// ownURL reports whether u has the scheme and host of the source.
+func ownURL(source *Source, u *neturl.URL) bool {
+	base, err := neturl.Parse(source.baseURL())
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, base.Scheme) && strings.EqualFold(u.Host, base.Host)
+}
+
+// apiSend sends an API request with the shared client of source, bounded by
+// APITimeout unless it is a download, which is only authenticated on the
+// source's own host. Canceling ctx ends the request and any wait for the
+// rate limits before it.
+func apiSend(ctx context.Context, source *Source, method, url string, form neturl.Values, download bool) (*http.Response, error) {
+	client, err := httpClient(source)
+	if err != nil {
+		return nil, err
+	}
+	if download {
+		c := *client
+		c.Timeout = 0
+		client = &c
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("User-Agent", userAgent())
+	switch {
+	case download && !ownURL(source, req.URL):
+	case source.Token != "" && source.kind() == "bitbucket" && source.Username != "":
+		req.SetBasicAuth(source.Username, source.Token)
+	case source.Token != "":
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", source.Token))
+	}
+	l := limiterFor(source)
+	l.wait(ctx)
+	err = waitRate(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	l.observe(source, resp)
+	return resp, nil
+}
+
+// regexps caches the compiled re: patterns of the config. compilePatterns
+// fills a copy when the config is validated and before each run and swaps
+// it in, so webhook workers matching repos meanwhile read a complete map.
+var regexps atomic.Pointer[map[string]*regexp.Regexp]
+
+// compilePatterns compiles every re: prefixed Include and Exclude pattern so
+// an invalid expression fails validation instead of never matching.
+func compilePatterns(config *Config) error {
+	compiled := map[string]*regexp.Regexp{}
+	if old := regexps.Load(); old != nil {
+		for v, re := range *old {
+			compiled[v] = re
+		}
+	}
+	var errs []error
+	for _, source := range config.Sources {
+		for _, v := range append(append(source.include(), source.exclude()...), source.overridePatterns()...) {
+			if !strings.HasPrefix(v, "re:") {
+				continue
+			}
+			re, err := regexp.Compile(strings.TrimPrefix(v, "re:"))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("source [%s] pattern '%s': %w", source, v, err))
+				continue
+			}
+			compiled[v] = re
+		}
+	}
+	regexps.Store(&compiled)
+	return errors.Join(errs...)
+}
+
+// matches reports whether e equals or matches any of s. Entries prefixed
+// with re: are regular expressions, the others are globs.
+func matches(s []string, e string) bool {
+	compiled := regexps.Load()
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+		if strings.HasPrefix(v, "re:") {
+			if compiled == nil {
+				continue
+			}
+			if re := (*compiled)[v]; re != nil && re.MatchString(e) {
+				return true
+			}
+			continue
+		}
+		if glob(strings.Split(v, "/"), strings.Split(e, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRepo reports whether any pattern matches the repo's full URL, its
+// path with namespace or its path.
+func matchesRepo(s []string, repo *Repo) bool {
+	return matches(s, repo.HTTPURLToRepo) || matches(s, repo.PathWithNamespace) || matches(s, repo.Path)
+}
+
+// glob matches path segments against pattern segments with path.Match,
+// where a ** segment matches any number of segments, including none.
+func glob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if glob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		matched, err := path.Match(pattern[0], name[0])
+		if err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func localPath(config *Config, source *Source, repo *Repo) string {
+	path, _ := renderPath(source, repo)
+	local := filepath.Join(destination(config, source, repo), path)
+	if source.root != "" {
+		local = filepath.Join(source.root, strings.TrimPrefix(path, source.dir()))
+	}
+	if !source.bare() {
+		return local
+	}
+	return fmt.Sprintf("%s.git", local)
+}
+
+func destination(config *Config, source *Source, repo *Repo) string {
+	for _, rule := range config.RoutingRules {
+		for _, topic := range repo.Topics {
+			if matches(rule.Topics, topic) {
+				return rule.Destination
+			}
+		}
+	}
+	return source.destination(config)
+}
+
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+func ingroups(groups []string, path string) bool {
+	for _, g := range groups {
+		g = strings.Trim(g, "/")
+		if path == g || strings.HasPrefix(path, g+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func archived(source *Source, repo *Repo) bool {
+	return repo.Archived && !source.IncludeArchived
+}
+
+func skip(source *Source, repo *Repo) bool {
+	return skipReason(source, repo) != ""
+}
+
+// skipReason returns why the filters of source leave out repo, or "" when
+// it is selected.
+func skipReason(source *Source, repo *Repo) string {
+	if archived(source, repo) {
+		return "archived"
+	}
+	if repo.EmptyRepo {
+		return "empty repository"
+	}
+	if len(source.Visibility) > 0 && !contains(source.Visibility, repo.Visibility) {
+		return "visibility " + repo.Visibility + " not in Visibility"
+	}
+	if matchesRepo(source.exclude(), repo) {
+		return "matches Exclude"
+	}
+	if include := source.include(); len(include) > 0 && !matchesRepo(include, repo) {
+		return "not in Include"
+	}
+	if reason := topicReason(source, repo); reason != "" {
+		return reason
+	}
+	if source.Owner != "" && repo.Namespace.FullPath != source.Owner && strconv.Itoa(repo.Namespace.ID) != source.Owner {
+		return "not owned by Owner"
+	}
+	namespace := path.Dir(repo.PathWithNamespace)
+	if ingroups(source.ExcludeGroups, namespace) {
+		return "in ExcludeGroups"
+	}
+	if len(source.IncludeGroups) > 0 && !ingroups(source.IncludeGroups, namespace) {
+		return "not in IncludeGroups"
+	}
+	return ""
+}
+
+// tooBig reports whether err is a clone failure caused by the size of the
+// repo: the remote refusing to send a pack that large, or the clone timing
+// out.
+func tooBig(err error) bool {
+	if strings.HasPrefix(err.Error(), "timed out: ") {
+		return true
+	}
+	var e *gitError
+	return errors.As(err, &e) && strings.Contains(e.stderr, "pack exceeds maximum allowed size")
+}
+
+// denied reports whether err is a git failure caused by the remote refusing
+// access, as happens for private repos when the source has no token or one
+// without access to the repo.
+func denied(err error) bool {
+	var e *gitError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, s := range []string{"returned error: 401", "returned error: 403", "HTTP Basic: Access denied", "Authentication failed", "could not read Username", "terminal prompts disabled"} {
+		if strings.Contains(e.stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone clones url into local. A depth above zero makes a shallow clone of
+// every branch and a filter makes a partial clone. Bare clones that are
+// shallow or limited to refspecs are initialized and fetched explicitly
+// since --mirror cannot be combined with either; shallow ones default to
+// every branch and tag.
+func clone(ctx context.Context, url, local string, bare bool, depth int, filter string, refspecs []string, auth []string, w io.Writer) (*exec.Cmd, error) {
+	var opts []string
+	if filter != "" {
+		opts = []string{"--filter=" + filter}
+	}
+	if bare && (depth > 0 || len(refspecs) > 0) {
+		if len(refspecs) == 0 {
+			refspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+		}
+		cmd, err := runGit(w, "init", "--bare", local)
+		if err != nil {
+			return cmd, err
+		}
+		cmd, err = runGit(w, "-C", local, "config", "--local", "remote.origin.url", url)
+		if err != nil {
+			return cmd, err
+		}
+		cmd, err = setRefspecs(local, refspecs, w)
+		if err != nil {
+			return cmd, err
+		}
+		args := append(auth, "-C", local, "fetch")
+		if depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(depth))
+		}
+		args = append(args, opts...)
+		return runGitContext(ctx, w, append(args, "origin")...)
+	}
+	if depth > 0 {
+		opts = append(opts, "--depth", strconv.Itoa(depth), "--no-single-branch")
+	} else if bare {
+		opts = append(opts, "--mirror")
+	}
+	args := append(append(auth, "clone"), opts...)
+	return runGitContext(ctx, w, append(args, url, local)...)
+}
+
+// gitdir returns the git directory of local, which is local itself for bare
+// mirrors and local/.git for checkouts.
+func gitdir(local string) string {
+	dir := filepath.Join(local, ".git")
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return dir
+	}
+	return local
+}
+
+// valid reports whether local is a git repository of its own: it has HEAD
+// and objects, and git resolves it to its own git dir rather than to a
+// repository further up the tree.
+func valid(local string) bool {
+	dir := gitdir(local)
+	for _, name := range []string{"HEAD", "objects"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	out, err := gitOutput(nil, "-C", local, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return false
+	}
+	resolved, err := os.Stat(strings.TrimSpace(string(out)))
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(dir)
+	return err == nil && os.SameFile(resolved, fi)
+}
+
+func touch(local string) error {
+	dir := gitdir(local)
+	now := time.Now()
+	for _, name := range []string{filepath.Join(dir, "refs", ".gitkeep"), filepath.Join(dir, "objects", ".gitkeep")} {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		err = os.Chtimes(name, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects returns the size of the largest pack of the mirror at local and
+// its number of loose objects.
+func objects(local string) (largestsize int64, loose int64, err error) {
+	err = filepath.WalkDir(filepath.Join(gitdir(local), "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if len(filepath.Base(filepath.Dir(path))) == 2 {
+			loose++
+		}
+		if !strings.HasSuffix(d.Name(), ".pack") {
+			return nil
+		}
+		fi, _err := d.Info()
+		if _err != nil {
+			return _err
+		}
+		if fi.Size() >= largestsize {
+			largestsize = fi.Size()
+		}
+		return nil
+	})
+	return
+}
+func repack(ctx context.Context, local, maxPackSize string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, "-C", local, "repack", "--max-pack-size="+maxPackSize, "-A", "-d")
+}
+
+func update(ctx context.Context, local string, auth []string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, append(auth, "-C", local, "remote", "update")...)
+}
+
+// setRefspecs replaces the fetch refspecs of the origin remote of local.
+func setRefspecs(local string, refspecs []string, w io.Writer) (*exec.Cmd, error) {
+	runGit(nil, "-C", local, "config", "--local", "--unset-all", "remote.origin.fetch")
+	for _, refspec := range refspecs {
+		cmd, err := runGit(w, "-C", local, "config", "--local", "--add", "remote.origin.fetch", refspec)
+		if err != nil {
+			return cmd, err
+		}
+	}
+	return nil, nil
+}
+
+// refresh fetches remote into the mirror at local. With prune, refs deleted
+// upstream are removed from the mirror whatever its refspecs; --prune-tags
+// is not passed since it would fetch every tag into mirrors limited by
+// Refs, whose tag refspecs are pruned by --prune already.
+func refresh(ctx context.Context, source *Source, remote, local string, prune bool, w io.Writer) (*exec.Cmd, error) {
+	if refspecs := source.refspecs(); len(refspecs) > 0 && source.bare() {
+		cmd, err := setRefspecs(local, refspecs, w)
+		if err != nil {
+			return cmd, err
+		}
+	}
+	flag := "--no-prune"
+	if prune {
+		flag = "--prune"
+	}
+	args := append(auth(source, remote), "-C", local)
+	if source.Depth > 0 {
+		if !source.bare() {
+			return runGitContext(ctx, w, append(args, "pull", "--ff-only", flag, "--depth", strconv.Itoa(source.Depth))...)
+		}
+		return runGitContext(ctx, w, append(args, "fetch", flag, "--depth", strconv.Itoa(source.Depth), "origin")...)
+	}
+	if !source.bare() {
+		return runGitContext(ctx, w, append(args, "pull", "--ff-only", flag)...)
+	}
+	return runGitContext(ctx, w, append(args, "fetch", flag, "origin")...)
+}
+
+func lfsfetch(ctx context.Context, local string, auth []string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, append(auth, "-C", local, "lfs", "fetch", "--all")...)
+}
+
+var lfs struct {
+	once sync.Once
+	err  error
+}
+
+// lfsInstalled returns an error if git-lfs is not available. It is checked
+// once per process.
+func lfsInstalled() error {
+	lfs.once.Do(func() {
+		_, err := gitOutput(nil, "lfs", "version")
+		if err != nil {
+			lfs.err = fmt.Errorf("git-lfs is not installed: %w", err)
+		}
+	})
+	return lfs.err
+}
+
+// fetchLFS fetches the LFS objects of a mirror. A failure is counted as
+// FailedLFS and leaves the mirror itself counted as successful.
+func fetchLFS(ctx context.Context, config *Config, source *Source, stat *Stat, remote, local string, w io.Writer) {
+	err := lfsInstalled()
+	if err == nil {
+		lctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+		_, err = lfsfetch(lctx, local, auth(source, remote), w)
+		cancel()
+	}
+	if err != nil {
+		stat.failf("Failed lfs fetch [%s] -> [%s]: %s", remote, local, err)
+		stat.FailedLFS++
+	}
+}
+
+func disablegc(local string, w io.Writer) (*exec.Cmd, error) {
+	return runGit(w, "-C", local, "config", "--local", "gc.auto", "0")
+}
+
+func pruneconfig(local string, prune bool, w io.Writer) (*exec.Cmd, error) {
+	return runGit(w, "-C", local, "config", "--local", "remote.origin.prune", strconv.FormatBool(prune))
+}
+
+func fsckconfig(local string, w io.Writer) (*exec.Cmd, error) {
+	for _, key := range []string{"fetch.fsckObjects", "transfer.fsckObjects"} {
+		cmd, err := runGit(w, "-C", local, "config", "--local", key, "true")
+		if err != nil {
+			return cmd, err
+		}
+	}
+	return nil, nil
+}
+
+func describe(local, remote string, repo *Repo, w io.Writer) (*exec.Cmd, error) {
+	if repo.Description != "" {
+		err := os.WriteFile(filepath.Join(gitdir(local), "description"), []byte(repo.Description+"\n"), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return runGit(w, "-C", local, "config", "--local", "remote.origin.url", mask(remote))
+}
+
+// sethead points HEAD of the bare mirror local at the upstream default
+// branch. It does nothing when branch is empty or not present in the mirror,
+// and never touches working-tree clones where HEAD is the checkout.
+func sethead(local, branch string, w io.Writer) (*exec.Cmd, error) {
+	if branch == "" {
+		return nil, nil
+	}
+	ref := "refs/heads/" + branch
+	if _, err := gitOutput(nil, "-C", local, "rev-parse", "--verify", "--quiet", ref); err != nil {
+		debugf("Default branch '%s' not found in [%s], keeping HEAD", branch, local)
+		return nil, nil
+	}
+	return runGit(w, "-C", local, "symbolic-ref", "HEAD", ref)
+}
+
+// authURL returns remote with the source credentials as userinfo:
+// oauth2:<token> when the source has a token, or just the username when it
+// only has a username. Bitbucket takes <username>:<app password> or
+// x-token-auth:<access token> instead.
+func authURL(source *Source, remote string) string {
+	u, err := neturl.Parse(remote)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return remote
+	}
+	switch {
+	case source.Token != "" && source.kind() == "bitbucket" && source.Username != "":
+		u.User = neturl.UserPassword(source.Username, source.Token)
+	case source.Token != "" && source.kind() == "bitbucket":
+		u.User = neturl.UserPassword("x-token-auth", source.Token)
+	case source.Token != "":
+		u.User = neturl.UserPassword("oauth2", source.Token)
+	case source.Username != "":
+		u.User = neturl.User(source.Username)
+	default:
+		return remote
+	}
+	return u.String()
+}
+
+// auth returns the git options that make git use authURL for remote. The
+// rewrite is passed with -c url.<auth>.insteadOf, so git only ever writes the
+// plain remote to the mirror's config and the token is never persisted.
+// Over ssh there is no token, only the optional core.sshCommand. The TLS
+// options of the source are passed the same way.
+func auth(source *Source, remote string) []string {
+	var args []string
+	if source.InsecureSkipVerify {
+		args = append(args, "-c", "http.sslVerify=false")
+	}
+	if source.CACertFile != "" {
+		args = append(args, "-c", "http.sslCAInfo="+source.CACertFile)
+	}
+	args = append(args, pinnedGit(source, remote)...)
+	if source.Protocol == "ssh" {
+		if source.SSHCommand == "" {
+			return args
+		}
+		return append(args, "-c", "core.sshCommand="+source.SSHCommand)
+	}
+	u := authURL(source, remote)
+	if u == remote {
+		return args
+	}
+	return append(args, "-c", fmt.Sprintf("url.%s.insteadOf=%s", u, remote))
+}
+
+func mask(remote string) string {
+	u, err := neturl.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+	u.User = nil
+	return u.String()
+}
+
+// probe runs ls-remote against the first selected repo of the source and
+// returns an error only when the failure looks like the host is down, not
+// when the repo itself is inaccessible.
+func probe(source *Source, repos []*Repo) error {
+	for _, repo := range repos {
+		if skip(source, repo) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		remote := source.remote(repo)
+		_, err := runGitContext(ctx, nil, append(auth(source, remote), "ls-remote", "--heads", remote)...)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if network(err) {
+			return err
+		}
+		return nil
+	}
+	return nil
+}
+
+// network reports whether err is a git failure caused by the network or an
+// unavailable remote rather than by the repo itself.
+func network(err error) bool {
+	var e *gitError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, s := range []string{"Could not resolve host", "Failed to connect", "Connection refused", "Connection reset", "Connection timed out", "timed out", "early EOF", "unexpected disconnect", "the remote end hung up", "returned error: 502", "returned error: 503", "returned error: 504"} {
+		if strings.Contains(e.stderr, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func refs(local string) (int, error) {
+	out, err := gitOutput(nil, "-C", local, "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		return 0, err
+	}
+	return bytes.Count(out, []byte("\n")), nil
+}
+
+// tips returns a digest of every ref and the object it points to, so two
+// calls can cheaply tell whether a fetch changed anything.
+func tips(local string) (string, error) {
+	out, err := gitOutput(nil, "-C", local, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(out)), nil
+}
+
+func fsck(local string, w io.Writer) (*exec.Cmd, error) {
+	return runGit(w, "-C", local, "fsck", "--full", "--no-dangling", "--no-progress")
+}
+
+func drifted(local string) (bool, error) {
+	b, err := os.ReadFile(filepath.Join(gitdir(local), "shallow"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(b) > 0 {
+		out, err := gitOutput(bytes.NewReader(b), "-C", local, "cat-file", "--batch-check")
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(out, []byte(" missing")) {
+			return true, nil
+		}
+	}
+	out, _ := gitOutput(nil, "-C", local, "config", "--local", "--get", "extensions.partialClone")
+	if len(bytes.TrimSpace(out)) > 0 {
+		if _, err := runGit(nil, "-C", local, "fsck", "--connectivity-only", "--no-progress"); err != nil {
+			var e *exec.ExitError
+			if errors.As(err, &e) {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// existingParent returns the closest ancestor of path that exists.
+func existingParent(path string) string {
+	for {
+		dir := filepath.Dir(path)
+		if _, err := os.Stat(dir); err == nil || dir == path {
+			return dir
+		}
+		path = dir
+	}
+}
+
+// tempPath returns the sibling of local a new mirror is cloned and set up in
+// before it is renamed into place, so an interrupted clone never leaves a
+// directory at local that later runs would take for a finished mirror.
+func tempPath(local string) string {
+	return fmt.Sprintf("%s.tmp-%d", local, os.Getpid())
+}
+
+var tempSuffix = regexp.MustCompile(`\.tmp-[0-9]+$`)
+
+// cleanTemp removes the temporary clones left behind by interrupted runs in
+// every destination. Mirrors themselves are not descended into.
+func cleanTemp(config *Config) {
+	seen := map[string]bool{}
+	for _, dir := range destinations(config) {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		var stale []string
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if tempSuffix.MatchString(d.Name()) {
+				stale = append(stale, path)
+				return filepath.SkipDir
+			}
+			if strings.HasSuffix(d.Name(), ".git") || gitdir(path) != path {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		for _, path := range stale {
+			infof("Removing stale temporary clone [%s]", path)
+			cleanup(path)
+		}
+	}
+}
+
+func cleanup(local string) {
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		err = remove(local)
+		if err == nil {
+			return
+		}
+		warnf("Failed to remove [%s] (attempt %d/3): %s", local, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	broken := fmt.Sprintf("%s.broken-%d", local, time.Now().Unix())
+	if _err := os.Rename(local, broken); _err != nil {
+		errorf("[%s] could not be removed or renamed and needs manual cleanup. remove error:'%s' rename error:'%s'", local, err, _err)
+		return
+	}
+	errorf("[%s] could not be removed and was renamed to [%s], it needs manual cleanup", local, broken)
+}
+
+func remove(local string) error {
+	return os.RemoveAll(local)
+}
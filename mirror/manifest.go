@@ -0,0 +1,92 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manifest lists every mirror present on disk after a run with its size and
+// ref tips, so manifests of two runs can be diffed and a restored mirror
+// checked against the one it was backed up from.
+type Manifest struct {
+	Generated time.Time        `json:"generated"`
+	Repos     []*ManifestEntry `json:"repos"`
+}
+
+type ManifestEntry struct {
+	Source  string            `json:"source"`
+	Path    string            `json:"path"`
+	Local   string            `json:"local"`
+	Size    int64             `json:"size"`
+	Objects int64             `json:"objects"`
+	Refs    map[string]string `json:"refs"`
+}
+
+func (c *Config) manifestFile() string {
+	if c.ManifestFile != "" {
+		return c.ManifestFile
+	}
+	return filepath.Join(c.Destination, "manifest.json")
+}
+
+func writeManifest(config *Config, stats []*Stat) error {
+	m := &Manifest{Generated: time.Now()}
+	for _, stat := range stats {
+		for _, repo := range stat.Repos {
+			local := localPath(config, stat.Source, repo)
+			if _, err := os.Stat(local); err != nil {
+				continue
+			}
+			entry, err := manifestEntry(local)
+			if err != nil {
+				warnf("Failed to add [%s] to manifest: %s", local, err)
+				continue
+			}
+			entry.Source = stat.Source.String()
+			entry.Path = repo.PathWithNamespace
+			m.Repos = append(m.Repos, entry)
+		}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(config.manifestFile(), b)
+}
+
+func manifestEntry(local string) (*ManifestEntry, error) {
+	entry := &ManifestEntry{Local: local, Refs: map[string]string{}}
+	size, err := du(gitdir(local))
+	if err != nil {
+		return nil, err
+	}
+	entry.Size = size
+	out, err := gitOutput(nil, "-C", local, "count-objects", "-v")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		k, v, _ := strings.Cut(scanner.Text(), ": ")
+		if k == "count" || k == "in-pack" {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			entry.Objects += n
+		}
+	}
+	out, err = gitOutput(nil, "-C", local, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if sha, ref, ok := strings.Cut(line, " "); ok {
+			entry.Refs[ref] = sha
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,58 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// projectMetadata is what Source.Metadata archives of a project: the full
+// /projects/:id object and its members, including inherited ones.
+type projectMetadata struct {
+	Project json.RawMessage   `json:"project"`
+	Members []json.RawMessage `json:"members"`
+}
+
+// metadataPath returns the metadata file of the mirror at local, next to it.
+func metadataPath(local string) string {
+	return strings.TrimSuffix(local, ".git") + ".meta.json"
+}
+
+// metadata writes the settings and members of repo to the metadata file of
+// the mirror at local and reports whether it did. A failure is only logged
+// since the mirror itself is not affected.
+func metadata(ctx context.Context, config *Config, source *Source, repo *Repo, local string) bool {
+	if source.kind() != "gitlab" || repo.ID == 0 {
+		return false
+	}
+	var meta projectMetadata
+	url := fmt.Sprintf("%s/api/v4/projects/%d?statistics=true&license=true", source.baseURL(), repo.ID)
+	err := getJSON(ctx, config, source, fmt.Sprintf("metadata of [%s]", repo.PathWithNamespace), url, &meta.Project)
+	if err != nil {
+		warnf("Failed to get metadata of [%s]: %s", repo.PathWithNamespace, err)
+		return false
+	}
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/projects/%d/members/all?page=%d&per_page=100", source.baseURL(), repo.ID, page)
+		var members []json.RawMessage
+		err := getJSON(ctx, config, source, fmt.Sprintf("members of [%s]", repo.PathWithNamespace), url, &members)
+		if err != nil {
+			warnf("Failed to get members of [%s]: %s", repo.PathWithNamespace, err)
+			return false
+		}
+		meta.Members = append(meta.Members, members...)
+		if len(members) < 100 {
+			break
+		}
+	}
+	b, err := json.MarshalIndent(&meta, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(metadataPath(local), append(b, '\n'))
+	}
+	if err != nil {
+		warnf("Failed to write metadata of [%s]: %s", repo.PathWithNamespace, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics is a small Prometheus exposition of the run stats. It lives for
+// the whole process so counters keep growing across -interval runs.
+var metrics = &registry{
+	repos:     map[[2]string]float64{},
+	durations: map[string]*histogram{},
+}
+
+// durationBuckets are the upper bounds in seconds of the clone and update
+// duration histogram.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+type registry struct {
+	mu        sync.Mutex
+	repos     map[[2]string]float64
+	lastRun   float64
+	durations map[string]*histogram
+}
+
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// record adds the counters of a finished run.
+func (r *registry) record(stats []*Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stat := range stats {
+		source := stat.Source.String()
+		for result, n := range map[string]int{
+			"mirrored":          stat.Mirrored,
+			"updated":           stat.Updated,
+			"moved":             stat.Moved,
+			"partial_updated":   stat.PartialUpdated,
+			"skipped":           stat.Skipped,
+			"skipped_no_access": stat.SkippedNoAccess,
+			"skipped_archived":  stat.SkippedArchived,
+			"skipped_empty":     stat.SkippedEmpty,
+			"skipped_topic":     stat.SkippedTopic,
+			"skipped_too_large": stat.SkippedTooLarge,
+			"skipped_failing":   stat.SkippedFailing,
+			"failed":            stat.Failed,
+			"failed_mirror":     stat.FailedMirror,
+			"failed_update":     stat.FailedUpdate,
+			"failed_lfs":        stat.FailedLFS,
+			"failed_too_big":    stat.FailedTooBig,
+			"rejected_host":     stat.RejectedHost,
+			"wikis":             stat.Wikis,
+			"failed_wiki":       stat.FailedWiki,
+			"pushed":            stat.Pushed,
+			"failed_push":       stat.FailedPush,
+			"bundles":           stat.Bundles,
+			"failed_bundle":     stat.FailedBundle,
+			"optimized":         stat.Optimized,
+			"uploaded":          stat.Uploaded,
+			"failed_upload":     stat.FailedUpload,
+			"pruned":            stat.Pruned,
+		} {
+			r.repos[[2]string{source, result}] += float64(n)
+		}
+	}
+	r.lastRun = float64(time.Now().Unix())
+}
+
+// observe records how long a clone or update took.
+func (r *registry) observe(op string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.durations[op]
+	if h == nil {
+		h = &histogram{counts: make([]float64, len(durationBuckets))}
+		r.durations[op] = h
+	}
+	s := d.Seconds()
+	for i, le := range durationBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# HELP gitlab_repo_mirror_repos_total Repos processed by source and result.\n")
+	b.WriteString("# TYPE gitlab_repo_mirror_repos_total counter\n")
+	var keys [][2]string
+	for k := range r.repos {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "gitlab_repo_mirror_repos_total{source=%q,result=%q} %g\n", k[0], k[1], r.repos[k])
+	}
+	b.WriteString("# HELP gitlab_repo_mirror_last_run_timestamp_seconds Unix time the last run finished.\n")
+	b.WriteString("# TYPE gitlab_repo_mirror_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "gitlab_repo_mirror_last_run_timestamp_seconds %g\n", r.lastRun)
+	b.WriteString("# HELP gitlab_repo_mirror_duration_seconds Duration of clones and updates.\n")
+	b.WriteString("# TYPE gitlab_repo_mirror_duration_seconds histogram\n")
+	var ops []string
+	for op := range r.durations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := r.durations[op]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(&b, "gitlab_repo_mirror_duration_seconds_bucket{op=%q,le=\"%g\"} %g\n", op, le, h.counts[i])
+		}
+		fmt.Fprintf(&b, "gitlab_repo_mirror_duration_seconds_bucket{op=%q,le=\"+Inf\"} %g\n", op, h.count)
+		fmt.Fprintf(&b, "gitlab_repo_mirror_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(&b, "gitlab_repo_mirror_duration_seconds_count{op=%q} %g\n", op, h.count)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,101 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// RunError is returned by Mirror when the run completed but did not
+// succeed. Code is the exit code the command would exit with, one of the
+// Exit constants.
+type RunError struct {
+	Code int
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("run failed with exit code %d", e.Code)
+}
+
+// LoadConfig reads the config as the command does: from file, a
+// comma-separated list of files and directories, or from the first of
+// config.json, config.yaml and config.yml in the working directory when
+// file is empty, with the MIRROR_ environment variables applied.
+func LoadConfig(file string) (*Config, error) {
+	return loadConfig(file)
+}
+
+// mirrorCalled is set by the first call of Mirror.
+var mirrorCalled atomic.Bool
+
+// Mirror validates config and does one run over every source, mirroring new
+// repos and updating existing ones exactly as one run of the command does,
+// state file, manifest, report and notification included. It returns the
+// stats of every source, and a *RunError along with them when the command
+// would exit non-zero. Canceling ctx kills the git commands in flight, as a
+// second signal does to the command, and no further repo is started.
+// Logging goes through the default slog logger.
+//
+// The run uses process-wide state, the git settings, slots, throttle and
+// compiled patterns among it, set up from config, so Mirror may be called
+// once per process; later calls return an error.
+func Mirror(ctx context.Context, config *Config) ([]*Stat, error) {
+	if mirrorCalled.Swap(true) {
+		return nil, errors.New("Mirror may only be called once per process")
+	}
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	err = setup(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.RateLimit > 0 && !config.DryRun {
+		err = startThrottle(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start bandwidth throttle: %w", err)
+		}
+	}
+	if !config.DryRun {
+		for _, dir := range destinations(config) {
+			err = ensureDir(dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cleanTemp(config)
+	}
+	var st *State
+	if !config.DryRun {
+		st, err = loadState(config.stateFile())
+		if err != nil {
+			warnf("Failed to load state [%s]: %s", config.stateFile(), err)
+			st = &State{Sources: map[string]*SourceState{}}
+		}
+	}
+	stats, code := cycle(ctx, config, &health{}, st)
+	if code != ExitOK {
+		return stats, &RunError{Code: code}
+	}
+	return stats, nil
+}
+
+// setup applies the process-wide settings of config: the API rate limit and
+// proxy, the allowed git commands, the git binary and its config, and the
+// API user agent and timeout.
+func setup(config *Config) error {
+	setRateLimit(config.APIRateLimit)
+	err := setProxy(config.Proxy)
+	if err != nil {
+		return err
+	}
+	err = allowGit(config.AllowedGitCommands)
+	if err != nil {
+		return err
+	}
+	setGit(config.GitBinary, config.GitConfig)
+	apiUserAgent, apiTimeout = config.UserAgent, config.apiTimeout()
+	return nil
+}
@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notify posts a summary of each run to a webhook. Format is slack, discord
+// or generic-json (default), which posts the same JSON as the json report.
+// Only runs with failures are posted unless Always is set.
+type Notify struct {
+	URL    string `yaml:"URL"`
+	Format string `yaml:"Format"`
+	Always bool   `yaml:"Always"`
+}
+
+// notify posts the summary of stats to the webhook. Errors are returned
+// for logging only; they never fail the run.
+func notify(n *Notify, stats []*Stat) error {
+	failed := 0
+	var lines []string
+	for _, stat := range stats {
+		f := stat.Failed + stat.FailedMirror + stat.FailedUpdate
+		if stat.DiscoveryFailed {
+			f++
+		}
+		failed += f
+		lines = append(lines, fmt.Sprintf("%s: repos:%d mirrored:%d updated:%d failed:%d", stat.Source, len(stat.Repos), stat.Mirrored, stat.Updated, f))
+	}
+	if failed == 0 && !n.Always {
+		return nil
+	}
+	text := "Mirror run finished"
+	if failed > 0 {
+		text = fmt.Sprintf("Mirror run finished with %d failures", failed)
+	}
+	text += "\n" + strings.Join(lines, "\n")
+
+	var body any
+	switch n.Format {
+	case "slack":
+		body = map[string]string{"text": text}
+	case "discord":
+		body = map[string]string{"content": text}
+	case "", "generic-json":
+		var reports []*sourceReport
+		for _, stat := range stats {
+			reports = append(reports, &sourceReport{Source: stat.Source.String(), Repos: len(stat.Repos), Stat: stat})
+		}
+		body = reports
+	default:
+		return fmt.Errorf("unknown notify format '%s'", n.Format)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
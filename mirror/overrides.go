@@ -0,0 +1,126 @@
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Override holds the settings of Source.Overrides for the repos it
+// matches. Unset fields keep the source's or the global setting.
+type Override struct {
+	CloneTimeout    Duration `yaml:"CloneTimeout"`
+	UpdateTimeout   Duration `yaml:"UpdateTimeout"`
+	Depth           *int     `yaml:"Depth"`
+	Refs            []string `yaml:"Refs"`
+	MaxRepoSize     Size     `yaml:"MaxRepoSize"`
+	RepackThreshold Size     `yaml:"RepackThreshold"`
+	Verify          *bool    `yaml:"Verify"`
+	LFS             *bool    `yaml:"LFS"`
+	Wikis           *bool    `yaml:"Wikis"`
+	NoUpdate        *bool    `yaml:"NoUpdate"`
+	NoPrune         *bool    `yaml:"NoPrune"`
+}
+
+// overridePatterns returns the patterns of Overrides in the order they are
+// applied, sorted, so of several matching overrides setting the same field
+// the last in that order wins.
+func (s *Source) overridePatterns() []string {
+	patterns := make([]string, 0, len(s.Overrides))
+	for pattern := range s.Overrides {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// effective returns the config and source repo is processed with: the
+// given ones when no override matches its path with namespace, otherwise
+// copies with every matching override applied in overridePatterns order.
+func effective(config *Config, source *Source, repo *Repo) (*Config, *Source) {
+	var matched []*Override
+	for _, pattern := range source.overridePatterns() {
+		if matches([]string{pattern}, repo.PathWithNamespace) {
+			matched = append(matched, source.Overrides[pattern])
+		}
+	}
+	if len(matched) == 0 {
+		return config, source
+	}
+	c, s := *config, *source
+	s.base = source.origin()
+	for _, o := range matched {
+		if o.CloneTimeout > 0 {
+			c.CloneTimeout = o.CloneTimeout
+		}
+		if o.UpdateTimeout > 0 {
+			c.UpdateTimeout = o.UpdateTimeout
+		}
+		if o.RepackThreshold > 0 {
+			c.RepackThreshold = o.RepackThreshold
+		}
+		if o.Verify != nil {
+			c.Verify = *o.Verify
+		}
+		if o.Depth != nil {
+			s.Depth = *o.Depth
+		}
+		if o.Refs != nil {
+			s.Refs = o.Refs
+		}
+		if o.MaxRepoSize > 0 {
+			s.MaxRepoSize = o.MaxRepoSize
+		}
+		if o.LFS != nil {
+			s.LFS = *o.LFS
+		}
+		if o.Wikis != nil {
+			s.Wikis = *o.Wikis
+		}
+		if o.NoUpdate != nil {
+			s.NoUpdate = *o.NoUpdate
+		}
+		if o.NoPrune != nil {
+			s.NoPrune = *o.NoPrune
+		}
+	}
+	return &c, &s
+}
+
+// origin returns the configured source an effective copy was made from,
+// or the source itself.
+func (s *Source) origin() *Source {
+	if s.base != nil {
+		return s.base
+	}
+	return s
+}
+
+// validateOverrides checks the overrides of source like the settings they
+// replace.
+func validateOverrides(source *Source) []error {
+	var errs []error
+	for _, pattern := range source.overridePatterns() {
+		o := source.Overrides[pattern]
+		if o == nil {
+			errs = append(errs, fmt.Errorf("source [%s] override '%s' is empty", source, pattern))
+			continue
+		}
+		if o.CloneTimeout < 0 || o.UpdateTimeout < 0 {
+			errs = append(errs, fmt.Errorf("source [%s] override '%s' timeout %s is negative", source, pattern, time.Duration(min(o.CloneTimeout, o.UpdateTimeout))))
+		}
+		if o.Depth != nil && *o.Depth < 0 {
+			errs = append(errs, fmt.Errorf("source [%s] override '%s' Depth %d is negative", source, pattern, *o.Depth))
+		}
+		for _, ref := range o.Refs {
+			if !strings.HasPrefix(ref, "refs/") {
+				errs = append(errs, fmt.Errorf("source [%s] override '%s' ref '%s' does not start with refs/", source, pattern, ref))
+			}
+		}
+		if len(o.Refs) > 0 && !source.bare() {
+			errs = append(errs, fmt.Errorf("source [%s] override '%s' Refs requires bare mirrors", source, pattern))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,78 @@
+package mirror
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPatterns reads a pattern file: one pattern per line, blank lines and
+// lines starting with # ignored.
+func readPatterns(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// readPatternFiles reads the IncludeFile and ExcludeFile of every source.
+// It runs at startup and before every run so edits take effect without a
+// restart; a source whose file cannot be read keeps its previous patterns.
+func readPatternFiles(config *Config) error {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	var errs []error
+	for _, source := range config.Sources {
+		if source.IncludeFile != "" {
+			patterns, err := readPatterns(source.IncludeFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("source [%s] IncludeFile: %w", source, err))
+			} else {
+				source.fileInclude = patterns
+			}
+		}
+		if source.ExcludeFile != "" {
+			patterns, err := readPatterns(source.ExcludeFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("source [%s] ExcludeFile: %w", source, err))
+			} else {
+				source.fileExclude = patterns
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadPatterns rereads the pattern files before a run.
+func reloadPatterns(config *Config) {
+	err := readPatternFiles(config)
+	if err == nil {
+		err = compilePatterns(config)
+	}
+	if err != nil {
+		warnf("Failed to reload pattern files: %s", err)
+	}
+}
+
+// include returns Include followed by the patterns of IncludeFile.
+func (s *Source) include() []string {
+	return append(append([]string{}, s.Include...), s.fileInclude...)
+}
+
+// exclude returns Exclude followed by the patterns of ExcludeFile.
+func (s *Source) exclude() []string {
+	return append(append([]string{}, s.Exclude...), s.fileExclude...)
+}
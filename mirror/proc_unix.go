@@ -0,0 +1,18 @@
+//go:build !windows
+
+package mirror
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup runs cmd in its own process group and makes context
+// cancellation kill the whole group, so helpers git spawns for the transfer
+// (remote-https, index-pack, ...) die with it.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package mirror
+
+import "os/exec"
+
+// killGroup keeps the default cancellation, which kills the git process.
+func killGroup(cmd *exec.Cmd) {}
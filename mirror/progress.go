@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// progress records, per source, the ID of the last repo processed in the
+// current cycle so that runs bounded by Config.MaxReposPerRun continue where
+// the previous one stopped. A source's cursor is dropped once every repo of
+// that source has been processed.
+type progress struct {
+	Cursors map[string]int
+}
+
+func loadProgress(file string) (*progress, error) {
+	p := &progress{Cursors: map[string]int{}}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Cursors == nil {
+		p.Cursors = map[string]int{}
+	}
+	return p, nil
+}
+
+func (p *progress) save(file string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+func writeFileAtomic(file string, b []byte) error {
+	tmp := file + ".tmp"
+	err := os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
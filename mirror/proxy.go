@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	neturl "net/url"
+)
+
+// proxyURL is the proxy set by Config.Proxy. When nil the API client uses
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY from the environment, which git
+// honors as well.
+var proxyURL *neturl.URL
+
+// gitEnv holds extra environment variables for git subprocesses.
+var gitEnv []string
+
+// setProxy routes API and git traffic through proxy, an http, https or
+// socks5 URL. An empty proxy keeps the environment settings.
+func setProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := neturl.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid Proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported Proxy scheme '%s'", u.Scheme)
+	}
+	proxyURL = u
+	gitEnv = append(gitEnv, "http_proxy="+proxy, "https_proxy="+proxy, "HTTP_PROXY="+proxy, "HTTPS_PROXY="+proxy)
+	return nil
+}
+
+// idleConnsPerHost is how many idle API connections are kept per host. The
+// net/http default of 2 is below the usual worker count, so most requests
+// of a busy source would otherwise open a new connection.
+const idleConnsPerHost = 16
+
+// newTransport returns a transport with the proxy settings applied.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = idleConnsPerHost
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport
+}
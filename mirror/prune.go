@@ -0,0 +1,61 @@
+package mirror
+
+import "path/filepath"
+
+// prune removes the mirrors under the source's domain subtree that do not
+// correspond to any repo returned by discovery. It must only be called with a
+// successful discovery result. Only the subtrees of the source's own
+// destinations are considered, and a mirror outside of them is never
+// removed.
+func prune(config *Config, source *Source, stat *Stat, repos []*Repo) {
+	if len(repos) == 0 {
+		infof("Source [%s] returned no repos, not pruning", source)
+		return
+	}
+	expected := map[string]bool{}
+	for _, repo := range repos {
+		local := localPath(config, source, repo)
+		expected[local] = true
+		expected[wikiPath(local)] = true
+	}
+	mirrors, err := localMirrors(config, source)
+	if err != nil {
+		warnf("Failed to walk mirrors of source [%s], not pruning. error:'%s'", source, err)
+		return
+	}
+	var roots []string
+	for _, dir := range source.destinations(config) {
+		roots = append(roots, filepath.Join(dir, layoutRoot(source)))
+	}
+	for _, local := range mirrors {
+		if expected[local] {
+			continue
+		}
+		if !withinAny(local, roots) {
+			warnf("Not pruning [%s]: outside the subtrees of source [%s]", local, source)
+			continue
+		}
+		if config.DryRun {
+			infof("Would prune [%s]", local)
+			stat.Pruned++
+			continue
+		}
+		err := remove(local)
+		if err != nil {
+			warnf("Failed to prune [%s]: %s", local, err)
+			continue
+		}
+		infof("Pruned [%s]", local)
+		stat.Pruned++
+	}
+}
+
+// withinAny reports whether path is below one of dirs.
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path != dir && within(path, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PushTarget is a second GitLab instance every mirror is pushed to with
+// push --mirror after it was mirrored or updated, at the same path with
+// namespace. Missing projects are created; their groups must already exist.
+type PushTarget struct {
+	URL   string `yaml:"URL"`
+	Token string `yaml:"Token"`
+
+	once   sync.Once
+	source *Source
+}
+
+// target returns the push target as a Source so the API helpers and the
+// credential injection of git can be reused.
+func (t *PushTarget) target() *Source {
+	t.once.Do(func() {
+		t.source = &Source{APIBaseURL: t.URL, Token: t.Token}
+		if u, err := neturl.Parse(t.URL); err == nil {
+			t.source.Domain = strings.Trim(u.Host+u.Path, "/")
+			t.source.Scheme = u.Scheme
+		}
+	})
+	return t.source
+}
+
+func (t *PushTarget) remote(repo *Repo) string {
+	return fmt.Sprintf("%s/%s.git", strings.TrimRight(t.URL, "/"), repo.PathWithNamespace)
+}
+
+func push(ctx context.Context, local string, auth []string, remote string, w io.Writer) (*exec.Cmd, error) {
+	return runGitContext(ctx, w, append(auth, "-C", local, "push", "--mirror", remote)...)
+}
+
+// pushMirror pushes the mirror at local to the push target, creating the
+// project there first if needed. Failures are counted as FailedPush and do
+// not affect the mirror itself.
+func pushMirror(ctx context.Context, config *Config, stat *Stat, repo *Repo, local string, w io.Writer) {
+	target := config.PushTo.target()
+	remote := config.PushTo.remote(repo)
+	err := ensureProject(ctx, target, repo)
+	if err == nil {
+		err = retry(ctx, config, fmt.Sprintf("push [%s]", remote), network, func() error {
+			pctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+			defer cancel()
+			_, err := push(pctx, local, auth(target, remote), remote, w)
+			return err
+		})
+	}
+	if err != nil {
+		stat.failf("Failed push [%s] -> [%s]: %s", local, remote, err)
+		stat.FailedPush++
+		return
+	}
+	infof("Successfully push [%s] -> [%s]", local, remote)
+	stat.Pushed++
+}
+
+// ensureProject creates repo on target under its namespace unless a
+// project already exists at that path.
+func ensureProject(ctx context.Context, target *Source, repo *Repo) error {
+	resp, err := apiGet(ctx, target, fmt.Sprintf("%s/api/v4/projects/%s", target.baseURL(), neturl.PathEscape(repo.PathWithNamespace)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return checkStatus(target, resp)
+	}
+
+	namespace := path.Dir(repo.PathWithNamespace)
+	resp, err = apiGet(ctx, target, fmt.Sprintf("%s/api/v4/namespaces/%s", target.baseURL(), neturl.PathEscape(namespace)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = checkStatus(target, resp)
+	if err != nil {
+		return fmt.Errorf("namespace %s: %w", namespace, err)
+	}
+	var ns struct {
+		ID int `json:"id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ns)
+	if err != nil {
+		return err
+	}
+
+	form := neturl.Values{}
+	form.Set("name", repo.Name)
+	form.Set("path", path.Base(repo.PathWithNamespace))
+	form.Set("namespace_id", fmt.Sprint(ns.ID))
+	form.Set("description", repo.Description)
+	form.Set("visibility", "private")
+	resp, err = apiDo(ctx, target, "POST", fmt.Sprintf("%s/api/v4/projects", target.baseURL()), form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = checkStatus(target, resp)
+	if err != nil {
+		return err
+	}
+	infof("Created project [%s] on [%s]", repo.PathWithNamespace, target)
+	return nil
+}
@@ -0,0 +1,46 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimits holds one token bucket per API domain so sources sharing a
+// host share its budget. It is empty unless Config.APIRateLimit is set.
+var rateLimits = struct {
+	sync.Mutex
+	limit float64
+	m     map[string]*rate.Limiter
+}{m: map[string]*rate.Limiter{}}
+
+// setRateLimit sets the API requests per second allowed per domain, where
+// zero disables client-side rate limiting.
+func setRateLimit(limit float64) {
+	rateLimits.Lock()
+	defer rateLimits.Unlock()
+	rateLimits.limit = limit
+	rateLimits.m = map[string]*rate.Limiter{}
+}
+
+// waitRate blocks until the domain of source may make another API call,
+// or returns the error of ctx when it is done first.
+func waitRate(ctx context.Context, source *Source) error {
+	rateLimits.Lock()
+	if rateLimits.limit <= 0 {
+		rateLimits.Unlock()
+		return nil
+	}
+	l, ok := rateLimits.m[source.Domain]
+	if !ok {
+		burst := int(rateLimits.limit)
+		if burst < 1 {
+			burst = 1
+		}
+		l = rate.NewLimiter(rate.Limit(rateLimits.limit), burst)
+		rateLimits.m[source.Domain] = l
+	}
+	rateLimits.Unlock()
+	return l.Wait(ctx)
+}
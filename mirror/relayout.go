@@ -0,0 +1,111 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// companions returns the files and directories kept next to the mirror at
+// local: its wiki, releases, snippets and metadata.
+func companions(local string) []string {
+	base := strings.TrimSuffix(local, ".git")
+	return []string{wikiPath(local), base + ".releases", base + ".snippets", metadataPath(local)}
+}
+
+// runRelayout moves every mirror recorded in the state file from the path
+// it was last mirrored at to the one the current PathTemplate gives it,
+// together with its wiki, releases, snippets and metadata, and records the
+// new paths in the state. The repos are listed from the sources so routing
+// rules and IDs apply as in a run. Mirrors whose new path is taken are left
+// in place, and so are sources with AtomicGeneration, whose generations are
+// rebuilt by the next run anyway. With DryRun the moves are only printed.
+func runRelayout(config *Config) int {
+	st, err := loadState(config.stateFile())
+	if err != nil {
+		errorf("Failed to load state [%s]: %s", config.stateFile(), err)
+		return ExitFailed
+	}
+	code := ExitOK
+	moved, kept, failed := 0, 0, 0
+	for _, source := range config.Sources {
+		ss := st.source(source)
+		if ss == nil {
+			continue
+		}
+		if source.AtomicGeneration {
+			warnf("Skipped relayout of source [%s]: AtomicGeneration", source)
+			continue
+		}
+		repos, _, err := getRepo(context.Background(), config, source)
+		if err != nil {
+			warnf("Failed to get source [%s] repos. error:'%s'", source, err)
+			code = ExitFailed
+			continue
+		}
+		for _, repo := range repos {
+			rs := ss.Repos[repo.PathWithNamespace]
+			if rs == nil || rs.Local == "" {
+				continue
+			}
+			old, local := rs.Local, localPath(config, source, repo)
+			if old == local {
+				kept++
+				continue
+			}
+			if !valid(old) {
+				debugf("Skipped relayout of [%s]: no mirror at [%s]", repo.PathWithNamespace, old)
+				continue
+			}
+			if _, err := os.Lstat(local); err == nil {
+				warnf("Failed to relayout [%s] -> [%s]: destination exists", old, local)
+				failed++
+				continue
+			}
+			if config.DryRun {
+				fmt.Printf("would move %s -> %s\n", old, local)
+				moved++
+				continue
+			}
+			err := os.MkdirAll(filepath.Dir(local), 0755)
+			if err == nil {
+				err = os.Rename(old, local)
+			}
+			if err != nil {
+				warnf("Failed to relayout [%s] -> [%s]: %s", old, local, err)
+				failed++
+				continue
+			}
+			from, to := companions(old), companions(local)
+			for i := range from {
+				if _, err := os.Stat(from[i]); err != nil {
+					continue
+				}
+				if err := os.Rename(from[i], to[i]); err != nil {
+					warnf("Failed to relayout [%s] -> [%s]: %s", from[i], to[i], err)
+				}
+			}
+			rs.Local = local
+			infof("Moved [%s] -> [%s]", old, local)
+			moved++
+		}
+	}
+	if moved > 0 && !config.DryRun {
+		err = st.save(config.stateFile())
+		if err != nil {
+			errorf("Failed to save state [%s]: %s", config.stateFile(), err)
+			code = ExitFailed
+		}
+	}
+	verb := "moved"
+	if config.DryRun {
+		verb = "to move"
+	}
+	fmt.Printf("%d mirrors %s, %d already in place, %d failed\n", moved, verb, kept, failed)
+	if failed > 0 {
+		code = ExitFailed
+	}
+	return code
+}
@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Release struct {
+	TagName string `json:"tag_name"`
+	Assets  struct {
+		Links []*ReleaseLink `json:"links"`
+	} `json:"assets"`
+}
+
+type ReleaseLink struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	DirectAssetURL string `json:"direct_asset_url"`
+}
+
+// releases downloads the asset links of every release of repo into a
+// releases directory next to the mirror and returns the number of assets
+// downloaded. Assets already on disk are not downloaded again.
+func releases(ctx context.Context, source *Source, repo *Repo, local string) int {
+	if source.kind() != "gitlab" {
+		return 0
+	}
+	dir := strings.TrimSuffix(local, ".git") + ".releases"
+	downloaded := 0
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/projects/%d/releases?page=%d&per_page=100", source.baseURL(), repo.ID, page)
+		pageReleases, err := getReleasePage(ctx, source, url)
+		if err != nil {
+			warnf("Failed to get releases for [%s]: %s", repo.PathWithNamespace, err)
+			return downloaded
+		}
+		if len(pageReleases) == 0 {
+			return downloaded
+		}
+		for _, release := range pageReleases {
+			for _, link := range release.Assets.Links {
+				path := filepath.Join(dir, filepath.Base(release.TagName), filepath.Base(link.Name))
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+				url := link.DirectAssetURL
+				if url == "" {
+					url = link.URL
+				}
+				err := download(ctx, source, url, path)
+				if err != nil {
+					warnf("Failed to download release asset [%s] -> [%s]: %s", url, path, err)
+					continue
+				}
+				downloaded++
+			}
+		}
+	}
+}
+
+func getReleasePage(ctx context.Context, source *Source, url string) ([]*Release, error) {
+	resp, err := apiGet(ctx, source, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	err = checkStatus(source, resp)
+	if err != nil {
+		return nil, err
+	}
+	var releases []*Release
+	err = json.NewDecoder(resp.Body).Decode(&releases)
+	if err != nil {
+		return nil, err
+	}
+	return releases, nil
+}
+
+func download(ctx context.Context, source *Source, url, path string) error {
+	resp, err := apiDownload(ctx, source, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if _err := f.Close(); err == nil {
+		err = _err
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,62 @@
+package mirror
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// movedMirrors maps the IDs of repos whose local path changed since the last
+// run, because the project was renamed or moved, to their previous path.
+// Paths claimed by a repo of the current listing are left alone.
+func movedMirrors(config *Config, source *Source, ss *SourceState, repos []*Repo) map[int]string {
+	if ss == nil {
+		return nil
+	}
+	current := map[int]string{}
+	claimed := map[string]bool{}
+	for _, repo := range repos {
+		if repo.ID == 0 {
+			continue
+		}
+		local := localPath(config, source, repo)
+		current[repo.ID] = local
+		claimed[local] = true
+	}
+	moved := map[int]string{}
+	for _, rs := range ss.Repos {
+		local, ok := current[rs.ID]
+		if rs.ID == 0 || rs.Local == "" || !ok || local == rs.Local || claimed[rs.Local] {
+			continue
+		}
+		moved[rs.ID] = rs.Local
+	}
+	return moved
+}
+
+// move renames the mirror of a renamed or moved project from its previous
+// path to local and points its origin at remote. It reports whether the
+// mirror was moved, in which case it only needs an update.
+func move(source *Source, repo *Repo, remote, local string, w io.Writer) bool {
+	old := source.moved[repo.ID]
+	if old == "" || !valid(old) {
+		return false
+	}
+	err := os.MkdirAll(filepath.Dir(local), 0755)
+	if err == nil {
+		err = os.Rename(old, local)
+	}
+	if err != nil {
+		warnf("Failed to move renamed mirror [%s] -> [%s], mirroring again: %s", old, local, err)
+		return false
+	}
+	if wiki := wikiPath(old); valid(wiki) {
+		os.Rename(wiki, wikiPath(local))
+	}
+	_, err = describe(local, remote, repo, w)
+	if err != nil {
+		warnf("Failed to set remote of moved mirror [%s]: %s", local, err)
+	}
+	infof("Moved renamed mirror [%s] -> [%s]", old, local)
+	return true
+}
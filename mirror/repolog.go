@@ -0,0 +1,38 @@
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// repoLogWriter opens the per-repo log of repo under the destination of its
+// source for one operation, rotating it first when it grew above
+// PerRepoLogSize. The caller closes it. It returns nil without PerRepoLogs.
+func repoLogWriter(config *Config, source *Source, repo *Repo) (io.WriteCloser, error) {
+	if !config.PerRepoLogs {
+		return nil, nil
+	}
+	path := fmt.Sprintf("%s.log", filepath.Join(source.destination(config), ".logs", source.dir(), repo.PathWithNamespace))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	size := config.PerRepoLogSize
+	if size <= 0 {
+		size = 1024 * 1024
+	}
+	fi, err := os.Stat(path)
+	if err == nil && fi.Size() > size {
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
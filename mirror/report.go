@@ -0,0 +1,37 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// sourceReport is the JSON form of a Stat, with the source and repo count in
+// place of the full objects.
+type sourceReport struct {
+	Source string `json:"source"`
+	Repos  int    `json:"repos"`
+	*Stat
+}
+
+// writeReport writes stats in the given format to file, or to stdout when
+// file is empty. The only format besides the default log summary is json.
+func writeReport(format, file string, stats []*Stat) error {
+	if format != "json" {
+		return fmt.Errorf("unknown report format '%s'", format)
+	}
+	var reports []*sourceReport
+	for _, stat := range stats {
+		reports = append(reports, &sourceReport{Source: stat.Source.String(), Repos: len(stat.Repos), Stat: stat})
+	}
+	b, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if file == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
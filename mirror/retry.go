@@ -0,0 +1,93 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type apiError struct {
+	StatusCode int
+	Domain     string
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("gitlab API returned %d for %s: %s", e.StatusCode, e.Domain, e.Body)
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "authentication failed: " + msg
+	case http.StatusTooManyRequests:
+		return "rate limited: " + msg
+	}
+	return msg
+}
+
+// checkStatus returns an *apiError carrying a snippet of the body when resp
+// is not a 2xx response.
+func checkStatus(source *Source, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	e := &apiError{
+		StatusCode: resp.StatusCode,
+		Domain:     source.Domain,
+		Body:       strings.TrimSpace(string(b)),
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	return e
+}
+
+// transientAPI reports whether an API error is worth retrying: network
+// errors and 5xx responses are, anything else is not.
+func transientAPI(err error) bool {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return ae.StatusCode >= 500 || ae.StatusCode == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// retry calls fn until it succeeds, fails with an error transient does not
+// accept, or Config.Retries retries are used up. Retries wait
+// Config.RetryBackoff * 2^attempt plus up to one backoff of jitter, or the
+// Retry-After of a rate limited API response.
+func retry(ctx context.Context, config *Config, what string, transient func(error) bool, fn func() error) error {
+	return retryN(ctx, config, config.Retries, what, transient, fn)
+}
+
+// retryN is retry with retries in place of Config.Retries.
+func retryN(ctx context.Context, config *Config, retries int, what string, transient func(error) bool, fn func() error) error {
+	backoff := time.Duration(config.RetryBackoff)
+	if backoff <= 0 {
+		backoff = 2 * time.Second
+	}
+	err := fn()
+	for attempt := 0; err != nil && attempt < retries && transient(err); attempt++ {
+		d := backoff<<attempt + time.Duration(rand.Int63n(int64(backoff)))
+		var ae *apiError
+		if errors.As(err, &ae) && ae.RetryAfter > 0 {
+			d = ae.RetryAfter
+		}
+		infof("Retrying %s in %s (retry %d/%d). error:'%s'", what, d.Round(time.Millisecond), attempt+1, retries, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package mirror
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Client is the client shared by every upload.
+var s3Client = sync.OnceValue(func() *http.Client {
+	return &http.Client{Transport: newTransport()}
+})
+
+// S3 uploads bundles to s3://<Bucket>/<Prefix>/<domain>/<path>.bundle.
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN. Endpoint selects an S3 compatible service such as MinIO
+// and switches to path-style URLs.
+type S3 struct {
+	Bucket   string `yaml:"Bucket"`
+	Prefix   string `yaml:"Prefix"`
+	Region   string `yaml:"Region"`
+	Endpoint string `yaml:"Endpoint"`
+	// DeleteLocal removes a bundle from BundleDir once it is uploaded.
+	DeleteLocal bool `yaml:"DeleteLocal"`
+}
+
+func (s *S3) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(strings.Trim(s.Prefix, "/")+"/"+name, "/")
+}
+
+// url returns the object URL of key. Its path is already in the escaped
+// form the signature is computed over.
+func (s *S3) url(key string) *neturl.URL {
+	path := "/" + awsEscape(key)
+	if s.Endpoint != "" {
+		u, err := neturl.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+		if err == nil {
+			u.RawPath = u.Path + "/" + awsEscape(s.Bucket) + path
+			u.Path = u.Path + "/" + s.Bucket + "/" + key
+			return u
+		}
+	}
+	return &neturl.URL{
+		Scheme:  "https",
+		Host:    fmt.Sprintf("%s.s3.%s.amazonaws.com", s.Bucket, s.region()),
+		Path:    "/" + key,
+		RawPath: path,
+	}
+}
+
+// upload puts file at key, signed with AWS Signature Version 4.
+func (s *S3) upload(file, key, sum string) error {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	u := s.url(key)
+	req, err := http.NewRequest(http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	now := time.Now().UTC()
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": sum,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signed := strings.Join(names, ";")
+	request := strings.Join([]string{http.MethodPut, u.EscapedPath(), "", canonical.String(), signed, sum}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.region())
+	digest := sha256.Sum256([]byte(request))
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", headers["x-amz-date"], scope, hex.EncodeToString(digest[:])}, "\n")
+	signing := []byte("AWS4" + secret)
+	for _, part := range []string{now.Format("20060102"), s.region(), "s3", "aws4_request"} {
+		signing = hmacSHA256(signing, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x", id, scope, signed, hmacSHA256(signing, toSign)))
+
+	resp, err := s3Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("S3 returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes every byte of s except unreserved characters and /, as
+// required for the canonical URI of a signature.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// fileSum returns the hex SHA-256 of file.
+func fileSum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,32 @@
+package mirror
+
+import (
+	"math/rand"
+	"time"
+)
+
+// jittered returns d moved by a random amount within ±jitter, at least 0.
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	d += time.Duration(rand.Int63n(2*int64(jitter)+1)) - jitter
+	return max(d, 0)
+}
+
+// startDelay waits a random time below window before the first run, so
+// instances started together do not all query the API at once. It reports
+// false when the process is stopped while waiting.
+func startDelay(window time.Duration) bool {
+	if window <= 0 {
+		return true
+	}
+	d := time.Duration(rand.Int63n(int64(window)))
+	infof("Delaying first run by %s", d.Round(time.Second))
+	select {
+	case <-stopping:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
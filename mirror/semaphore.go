@@ -0,0 +1,51 @@
+package mirror
+
+import "sync"
+
+// slots bounds the number of repos processed at once. global is shared by
+// every source and sized by Config.Concurrency; each source also has its own
+// semaphore sized by Source.Concurrency, so one large source cannot take
+// every global slot. A slot is always taken per-source first, then global.
+var slots struct {
+	once    sync.Once
+	global  chan struct{}
+	sources sync.Map
+}
+
+func globalSlots(config *Config) chan struct{} {
+	slots.once.Do(func() {
+		slots.global = make(chan struct{}, config.concurrency())
+	})
+	return slots.global
+}
+
+// sourceSlots returns the semaphore of source, shared by its effective
+// copies.
+func sourceSlots(config *Config, source *Source) chan struct{} {
+	source = source.origin()
+	if s, ok := slots.sources.Load(source); ok {
+		return s.(chan struct{})
+	}
+	s, _ := slots.sources.LoadOrStore(source, make(chan struct{}, source.concurrency(config)))
+	return s.(chan struct{})
+}
+
+// concurrency returns the per-source limit, defaulting to the global one.
+func (s *Source) concurrency(config *Config) int {
+	if s.Concurrency <= 0 || s.Concurrency > config.concurrency() {
+		return config.concurrency()
+	}
+	return s.Concurrency
+}
+
+// repoLocks holds a mutex per local mirror path so a repo is never processed
+// twice at once, e.g. by a run and a webhook for the same push.
+var repoLocks sync.Map
+
+// lockRepo locks the mirror at local and returns the unlock function.
+func lockRepo(local string) func() {
+	m, _ := repoLocks.LoadOrStore(local, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
@@ -0,0 +1,50 @@
+package mirror
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// stopping is closed on the first SIGINT or SIGTERM. No new repo or source is
+// started after that, but the repos in flight are allowed to finish.
+var stopping = make(chan struct{})
+
+var stopOnce sync.Once
+
+// stop stops the run as if a signal had been received.
+func stop() {
+	stopOnce.Do(func() { close(stopping) })
+}
+
+// halted reports whether no new repo may be started in the run of ctx,
+// because of a signal or because the run's context is done.
+func halted(ctx context.Context) bool {
+	return stopped() || ctx.Err() != nil
+}
+
+func stopped() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals closes stopping on the first signal and calls abort on the
+// second, which kills the git subprocesses still running.
+func handleSignals(abort context.CancelFunc) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		infof("Received %s, finishing the repos in progress. Send it again to abort them", s)
+		stop()
+		s = <-sig
+		infof("Received %s again, aborting the repos in progress", s)
+		abort()
+	}()
+}
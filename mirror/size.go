@@ -0,0 +1,64 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size is a number of bytes that is written in config files either as a
+// number or as a string with a unit such as "500MB" or "2GiB".
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func parseSize(s string) (Size, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	n := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, n = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.n
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return Size(f * float64(n)), nil
+}
+
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var v any
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*s = Size(v)
+	case string:
+		*s, err = parseSize(v)
+		return err
+	default:
+		return fmt.Errorf("invalid size %s", b)
+	}
+	return nil
+}
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	var err error
+	*s, err = parseSize(value.Value)
+	return err
+}
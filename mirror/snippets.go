@@ -0,0 +1,87 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Snippet struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	FileName string `json:"file_name"`
+	Files    []struct {
+		Path   string `json:"path"`
+		RawURL string `json:"raw_url"`
+	} `json:"files"`
+}
+
+// snippets downloads the snippets of repo into a snippets directory next to
+// the mirror, one directory per snippet ID holding its files, and returns
+// the number of snippets fetched. Snippets are downloaded again on every
+// call since they can be edited in place.
+func snippets(ctx context.Context, source *Source, repo *Repo, local string) int {
+	if source.kind() != "gitlab" {
+		return 0
+	}
+	dir := strings.TrimSuffix(local, ".git") + ".snippets"
+	fetched := 0
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/api/v4/projects/%d/snippets?page=%d&per_page=100", source.baseURL(), repo.ID, page)
+		pageSnippets, err := getSnippetPage(ctx, source, url)
+		if err != nil {
+			warnf("Failed to get snippets for [%s]: %s", repo.PathWithNamespace, err)
+			return fetched
+		}
+		if len(pageSnippets) == 0 {
+			return fetched
+		}
+		for _, snippet := range pageSnippets {
+			base := filepath.Join(dir, strconv.Itoa(snippet.ID))
+			ok := true
+			if len(snippet.Files) == 0 {
+				url := fmt.Sprintf("%s/api/v4/projects/%d/snippets/%d/raw", source.baseURL(), repo.ID, snippet.ID)
+				path := filepath.Join(base, filepath.Base(snippet.FileName))
+				if err := download(ctx, source, url, path); err != nil {
+					warnf("Failed to download snippet [%s] -> [%s]: %s", url, path, err)
+					ok = false
+				}
+			}
+			for _, file := range snippet.Files {
+				path := filepath.Join(base, filepath.Base(file.Path))
+				if err := download(ctx, source, file.RawURL, path); err != nil {
+					warnf("Failed to download snippet [%s] -> [%s]: %s", file.RawURL, path, err)
+					ok = false
+				}
+			}
+			if ok {
+				fetched++
+			}
+		}
+	}
+}
+
+func getSnippetPage(ctx context.Context, source *Source, url string) ([]*Snippet, error) {
+	resp, err := apiGet(ctx, source, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	err = checkStatus(source, resp)
+	if err != nil {
+		return nil, err
+	}
+	var snippets []*Snippet
+	err = json.NewDecoder(resp.Body).Decode(&snippets)
+	if err != nil {
+		return nil, err
+	}
+	return snippets, nil
+}
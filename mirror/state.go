@@ -0,0 +1,236 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// State is persisted to Config.StateFile after every run so monitoring can
+// tell when each repo was last mirrored or updated and whether the last run
+// of each source completed.
+type State struct {
+	// ConfigHash identifies the config of the last run, so a config change
+	// lifts MaxConsecutiveFailures skips.
+	ConfigHash string                  `json:"config_hash,omitempty"`
+	Sources    map[string]*SourceState `json:"sources"`
+}
+
+type SourceState struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Complete bool      `json:"complete"`
+	// LastComplete is the start of the last complete run, the bound of
+	// incremental listings.
+	LastComplete time.Time             `json:"last_complete"`
+	Repos        map[string]*RepoState `json:"repos"`
+}
+
+type RepoState struct {
+	// ID and Local identify the mirror of the project across renames.
+	ID          int        `json:"id,omitempty"`
+	Local       string     `json:"local,omitempty"`
+	LastSuccess time.Time  `json:"last_success"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// LastDuration is how long the git operations of the repo took in the
+	// last run that processed it.
+	LastDuration string `json:"last_duration,omitempty"`
+	// ConsecutiveFailures counts the runs in a row the repo failed in.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	// NoAccess is set when git was denied access to the repo, which is then
+	// skipped while the config stays the same.
+	NoAccess bool `json:"no_access,omitempty"`
+}
+
+func (c *Config) stateFile() string {
+	if c.StateFile != "" {
+		return c.StateFile
+	}
+	return filepath.Join(c.Destination, ".state.json")
+}
+
+// hash returns a digest of the config.
+func (c *Config) hash() string {
+	b, _ := json.Marshal(c)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// source returns the state of source, nil if st is nil or the source has
+// none yet.
+func (st *State) source(source *Source) *SourceState {
+	if st == nil {
+		return nil
+	}
+	return st.Sources[source.String()]
+}
+
+func (c *Config) staleAfter() time.Duration {
+	if c.StaleAfter <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.StaleAfter)
+}
+
+func loadState(file string) (*State, error) {
+	st := &State{Sources: map[string]*SourceState{}}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, st)
+	if err != nil {
+		return nil, err
+	}
+	if st.Sources == nil {
+		st.Sources = map[string]*SourceState{}
+	}
+	return st, nil
+}
+
+func (st *State) save(file string) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// Delta lists the repos of a source that changed between two runs: newly
+// listed, failing after succeeding, succeeding after failing, and Unlisted,
+// no longer listed and dropped from the state. Unlisted is unrelated to
+// Stat.Pruned, the mirrors Prune removed from disk.
+type Delta struct {
+	New          []string `json:"new,omitempty"`
+	NewlyFailing []string `json:"newly_failing,omitempty"`
+	Recovered    []string `json:"recovered,omitempty"`
+	Unlisted     []string `json:"unlisted,omitempty"`
+}
+
+func (d *Delta) String() string {
+	return fmt.Sprintf("+%d new, %d newly failing, %d recovered, %d unlisted", len(d.New), len(d.NewlyFailing), len(d.Recovered), len(d.Unlisted))
+}
+
+// delta compares the repos of a source in the previous and the new state.
+func delta(prev, next map[string]*RepoState) *Delta {
+	d := &Delta{}
+	for path, rs := range next {
+		old := prev[path]
+		if old == nil {
+			d.New = append(d.New, path)
+		}
+		switch {
+		case rs.ConsecutiveFailures > 0 && (old == nil || old.ConsecutiveFailures == 0):
+			d.NewlyFailing = append(d.NewlyFailing, path)
+		case rs.ConsecutiveFailures == 0 && old != nil && old.ConsecutiveFailures > 0:
+			d.Recovered = append(d.Recovered, path)
+		}
+	}
+	for path := range prev {
+		if next[path] == nil {
+			d.Unlisted = append(d.Unlisted, path)
+		}
+	}
+	sort.Strings(d.New)
+	sort.Strings(d.NewlyFailing)
+	sort.Strings(d.Recovered)
+	sort.Strings(d.Unlisted)
+	return d
+}
+
+// update merges the outcome of a run into the state and sets the Delta of
+// every stat whose source has a previous state. Repos that are no longer
+// listed by a source are dropped; a source whose discovery failed or whose
+// listing was incremental or incomplete keeps its previous repos.
+func (st *State) update(stats []*Stat) {
+	for _, stat := range stats {
+		prev := st.Sources[stat.Source.String()]
+		ss := &SourceState{
+			Started:  stat.Started,
+			Finished: stat.Finished,
+			Complete: stat.Complete,
+			Repos:    map[string]*RepoState{},
+		}
+		if prev != nil {
+			ss.LastComplete = prev.LastComplete
+		}
+		if stat.Complete && !stat.DiscoveryFailed {
+			ss.LastComplete = stat.Started
+		}
+		if stat.DiscoveryFailed {
+			if prev != nil {
+				ss.Repos = prev.Repos
+			}
+			st.Sources[stat.Source.String()] = ss
+			continue
+		}
+		if (stat.Incremental || stat.DiscoveryIncomplete) && prev != nil {
+			for path, rs := range prev.Repos {
+				ss.Repos[path] = rs
+			}
+		}
+		for _, repo := range stat.Repos {
+			rs := &RepoState{}
+			if prev != nil && prev.Repos[repo.PathWithNamespace] != nil {
+				*rs = *prev.Repos[repo.PathWithNamespace]
+			}
+			rs.ID = repo.ID
+			if s := stat.results[repo.PathWithNamespace]; s != nil {
+				if s.local != "" {
+					rs.Local = s.local
+				}
+				succeeded := s.Mirrored+s.Updated+s.PartialUpdated > 0
+				rs.NoAccess = s.noAccess
+				if s.took() > 0 {
+					rs.LastDuration = formatDuration(s.took())
+				}
+				if succeeded {
+					rs.LastSuccess = stat.Finished
+					rs.LastError = ""
+					rs.LastErrorAt = nil
+					rs.ConsecutiveFailures = 0
+				}
+				if s.Error != "" {
+					rs.LastError = s.Error
+					at := stat.Finished
+					rs.LastErrorAt = &at
+					if !succeeded {
+						rs.ConsecutiveFailures++
+					}
+				}
+			}
+			ss.Repos[repo.PathWithNamespace] = rs
+		}
+		if prev != nil {
+			stat.Delta = delta(prev.Repos, ss.Repos)
+		}
+		st.Sources[stat.Source.String()] = ss
+	}
+}
+
+// report logs, per source, how many repos have not been mirrored or updated
+// successfully within the last staleAfter.
+func (st *State) report(config *Config) {
+	for _, source := range config.Sources {
+		ss := st.Sources[source.String()]
+		if ss == nil {
+			continue
+		}
+		stale := 0
+		for _, rs := range ss.Repos {
+			if time.Since(rs.LastSuccess) > config.staleAfter() {
+				stale++
+			}
+		}
+		if stale > 0 {
+			infof("Source [%s]: %d repos not updated in %s", source, stale, config.staleAfter())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// findRepo resolves target, a path with namespace or an http(s) URL of a
+// repo, to the repo and the first source it is found on. A URL only
+// matches sources whose Domain it starts with; a plain path is looked up
+// on every source that supports single repo lookups.
+func findRepo(ctx context.Context, config *Config, target string) (*Source, *Repo, error) {
+	path := strings.Trim(target, "/")
+	var host string
+	if strings.Contains(target, "://") {
+		u, err := neturl.Parse(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		host = u.Host + strings.TrimSuffix(u.Path, ".git")
+	}
+	var errs []error
+	for _, source := range config.Sources {
+		if host != "" {
+			prefix := strings.Trim(source.Domain, "/") + "/"
+			if !strings.HasPrefix(host, prefix) {
+				continue
+			}
+			path = strings.Trim(strings.TrimPrefix(host, prefix), "/")
+		}
+		getter, ok := listers[source.kind()].(RepoGetter)
+		if !ok || len(source.ListCommand) > 0 {
+			continue
+		}
+		repo, err := getter.Get(ctx, config, source, path)
+		var ae *apiError
+		if errors.As(err, &ae) && ae.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("source [%s]: %w", source, err))
+			continue
+		}
+		languages(ctx, config, source, []*Repo{repo})
+		return source, repo, nil
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	return nil, nil, fmt.Errorf("no source has repo '%s'", target)
+}
+
+// mirrorRepo mirrors or updates a single repo of source with the same
+// processing as a full run, and returns its stat. The state file is not
+// touched since it describes full listings.
+func mirrorRepo(ctx context.Context, config *Config, source *Source, repo *Repo) *Stat {
+	stat := &Stat{
+		Source:  source,
+		Repos:   []*Repo{repo},
+		Started: time.Now(),
+	}
+	if reason := skipReason(source, repo); reason != "" {
+		infof("Skipped [%s] of source [%s]: %s", repo.PathWithNamespace, source, reason)
+		stat.Skipped++
+	} else {
+		work(ctx, config, source, stat, []*Repo{repo})
+	}
+	stat.Finished = time.Now()
+	return stat
+}
+
+// runRepo mirrors or updates only the repo given with -repo, looked up
+// directly instead of listing its source.
+func runRepo(ctx context.Context, config *Config, target string) int {
+	source, repo, err := findRepo(ctx, config, target)
+	if err != nil {
+		errorf("Failed to find repo [%s]: %s", target, err)
+		return ExitFailed
+	}
+	stat := mirrorRepo(ctx, config, source, repo)
+	infof("Repo [%s] of source [%s]: mirrored:%d updated:%d skipped:%d failed:%d", repo.PathWithNamespace, source, stat.Mirrored, stat.Updated, stat.Skipped, stat.Failed+stat.FailedMirror+stat.FailedUpdate)
+	if stopped() {
+		return ExitInterrupted
+	}
+	return exitCode(config, []*Stat{stat})
+}
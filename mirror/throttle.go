@@ -0,0 +1,236 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Git has no bandwidth limit of its own, so Config.RateLimit is applied by
+// a local proxy that git's HTTP(S) traffic is routed through. Every byte in
+// either direction of every connection takes tokens from one bucket, which
+// caps the aggregate bandwidth of all concurrent clones and fetches. HTTPS
+// is tunneled with CONNECT and stays end-to-end encrypted. SSH remotes and
+// API calls are not throttled. The proxy only connects to the hosts of the
+// sources and the push target, and reaches them through the HTTP(S) proxy
+// the environment sets for them as git would.
+
+// throttleChunk is the largest read passed through the bucket at once.
+const throttleChunk = 32 * 1024
+
+type throttle struct {
+	limiter *rate.Limiter
+	hosts   map[string]bool
+}
+
+// startThrottle starts the throttling proxy for Config.RateLimit on a
+// loopback port and points git subprocesses at it. It fails when the
+// environment sets a proxy other than http or https for one of the hosts.
+func startThrottle(config *Config) error {
+	limit := config.RateLimit
+	burst := int(limit)
+	if burst < throttleChunk {
+		burst = throttleChunk
+	}
+	t := &throttle{limiter: rate.NewLimiter(rate.Limit(limit), burst), hosts: throttleHosts(config)}
+	for host := range t.hosts {
+		for _, scheme := range []string{"http", "https"} {
+			proxy, err := envProxy(scheme, host)
+			if err != nil {
+				return err
+			}
+			if proxy != nil && proxy.Scheme != "http" && proxy.Scheme != "https" {
+				return fmt.Errorf("the %s proxy for %s from the environment cannot be chained", proxy.Scheme, host)
+			}
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go http.Serve(ln, t)
+	proxy := fmt.Sprintf("http://%s", ln.Addr())
+	gitEnv = append(gitEnv, "http_proxy="+proxy, "https_proxy="+proxy, "HTTP_PROXY="+proxy, "HTTPS_PROXY="+proxy, "no_proxy=", "NO_PROXY=")
+	debugf("Throttling git traffic to %d bytes/s through [%s]", limit, proxy)
+	return nil
+}
+
+// throttleHosts returns the hosts git may reach through the throttle: those
+// of the sources, their AllowedHosts and the push target.
+func throttleHosts(config *Config) map[string]bool {
+	hosts := map[string]bool{}
+	for _, source := range config.Sources {
+		hosts[strings.ToLower(source.hostname())] = true
+		for _, host := range source.AllowedHosts {
+			hosts[strings.ToLower(host)] = true
+		}
+	}
+	if config.PushTo != nil {
+		hosts[strings.ToLower(config.PushTo.target().hostname())] = true
+	}
+	return hosts
+}
+
+// envProxy returns the proxy the environment sets for URLs of scheme on
+// host, nil for none.
+func envProxy(scheme, host string) (*neturl.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: &neturl.URL{Scheme: scheme, Host: host}})
+}
+
+// allowed reports whether addr, a host with an optional port, is one of the
+// hosts of the throttle.
+func (t *throttle) allowed(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	return t.hosts[strings.ToLower(host)]
+}
+
+func (t *throttle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !t.allowed(r.Host) {
+		http.Error(w, fmt.Sprintf("host %s is not a configured source host", r.Host), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		t.tunnel(w, r)
+		return
+	}
+	r.RequestURI = ""
+	if r.Body != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{t.reader(r.Body), r.Body}
+	}
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, t.reader(resp.Body))
+}
+
+// tunnel connects the client to the requested host and copies the
+// connection both ways through the bucket.
+func (t *throttle) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := dialUpstream(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, t.reader(buf))
+		if c, ok := upstream.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, t.reader(upstream))
+		client.Close()
+	}()
+	wg.Wait()
+	upstream.Close()
+}
+
+// dialUpstream connects to addr, through a CONNECT tunnel of the https
+// proxy the environment sets for it if any.
+func dialUpstream(addr string) (net.Conn, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	proxy, err := envProxy("https", host)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return net.Dial("tcp", addr)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "80"
+		if proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &neturl.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)))
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxy.Host, addr, resp.Status)
+	}
+	return conn, nil
+}
+
+func (t *throttle) reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, limiter: t.limiter}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RepoTiming is how long the git operations of one repo took in a run.
+type RepoTiming struct {
+	Path   string `json:"path"`
+	Total  string `json:"total"`
+	Clone  string `json:"clone,omitempty"`
+	Update string `json:"update,omitempty"`
+	Repack string `json:"repack,omitempty"`
+	total  time.Duration
+}
+
+func (c *Config) slowestRepos() int {
+	if c.SlowestRepos <= 0 {
+		return 5
+	}
+	return c.SlowestRepos
+}
+
+// took returns the time the git operations of a repo's Stat took.
+func (s *Stat) took() time.Duration {
+	return s.cloneTime + s.updateTime + s.repackTime
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// slowest returns the n repos of stat whose git operations took longest.
+func slowest(stat *Stat, n int) []*RepoTiming {
+	var timings []*RepoTiming
+	for path, s := range stat.results {
+		if s.took() == 0 {
+			continue
+		}
+		timings = append(timings, &RepoTiming{
+			Path:   path,
+			Total:  formatDuration(s.took()),
+			Clone:  formatDuration(s.cloneTime),
+			Update: formatDuration(s.updateTime),
+			Repack: formatDuration(s.repackTime),
+			total:  s.took(),
+		})
+	}
+	sort.Slice(timings, func(i, j int) bool { return timings[i].total > timings[j].total })
+	if len(timings) > n {
+		timings = timings[:n]
+	}
+	return timings
+}
+
+// logSlowest logs the slowest repos of a source on one line.
+func logSlowest(stat *Stat) {
+	if len(stat.Slowest) == 0 {
+		return
+	}
+	var s []string
+	for _, t := range stat.Slowest {
+		s = append(s, fmt.Sprintf("%s %s", t.Path, t.Total))
+	}
+	infof("Source [%s] slowest repos: %s", stat.Source, strings.Join(s, ", "))
+}
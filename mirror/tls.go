@@ -0,0 +1,63 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// apiUserAgent and apiTimeout are Config.UserAgent and Config.apiTimeout,
+// set before the first API request.
+var (
+	apiUserAgent string
+	apiTimeout   time.Duration
+)
+
+// clients caches the API clients by source. Sources without TLS options
+// share the client stored under the empty key, so their connections are
+// pooled and kept alive across sources and pages.
+var clients sync.Map
+
+// httpClient returns the API client of source, built once with the
+// source's TLS, pinning and proxy options.
+func httpClient(source *Source) (*http.Client, error) {
+	source = source.origin()
+	if c, ok := clients.Load(source); ok {
+		return c.(*http.Client), nil
+	}
+	if source.CACertFile == "" && !source.InsecureSkipVerify && len(source.PinnedIPs) == 0 {
+		c, _ := clients.LoadOrStore("", &http.Client{Transport: newTransport(), Timeout: apiTimeout})
+		clients.Store(source, c)
+		return c.(*http.Client), nil
+	}
+	config := &tls.Config{}
+	if source.InsecureSkipVerify {
+		warnf("Source [%s] skips TLS certificate verification, this is insecure", source)
+		config.InsecureSkipVerify = true
+	}
+	if source.CACertFile != "" {
+		pem, err := os.ReadFile(source.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CACertFile [%s]", source.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+	transport := newTransport()
+	transport.TLSClientConfig = config
+	if len(source.PinnedIPs) > 0 {
+		transport.DialContext = pinnedDialer(source.hostname(), source.PinnedIPs)
+	}
+	c, _ := clients.LoadOrStore(source, &http.Client{Transport: transport, Timeout: apiTimeout})
+	return c.(*http.Client), nil
+}
@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// topicReason returns why the topic and language filters of source leave
+// out repo, or "" when they select it. Topics and languages compare case
+// insensitively.
+func topicReason(source *Source, repo *Repo) string {
+	for _, topic := range repo.Topics {
+		if containsFold(source.ExcludeTopics, topic) {
+			return "topic " + topic + " in ExcludeTopics"
+		}
+	}
+	if len(source.IncludeTopics) > 0 {
+		found := false
+		for _, topic := range repo.Topics {
+			if containsFold(source.IncludeTopics, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "no topic in IncludeTopics"
+		}
+	}
+	if containsFold(source.ExcludeLanguages, repo.Language) {
+		return "language " + repo.Language + " in ExcludeLanguages"
+	}
+	if len(source.IncludeLanguages) > 0 && !containsFold(source.IncludeLanguages, repo.Language) {
+		return "language " + repo.Language + " not in IncludeLanguages"
+	}
+	return ""
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// languages sets the primary language of every repo of a GitLab source
+// with language filters, the one with the largest share reported by
+// /projects/:id/languages. It costs an API call per repo, so it is only
+// done when IncludeLanguages or ExcludeLanguages is set. A repo whose
+// languages cannot be read keeps an empty language.
+func languages(ctx context.Context, config *Config, source *Source, repos []*Repo) {
+	if source.kind() != "gitlab" || (len(source.IncludeLanguages) == 0 && len(source.ExcludeLanguages) == 0) {
+		return
+	}
+	for _, repo := range repos {
+		if repo.Language != "" || repo.ID == 0 {
+			continue
+		}
+		url := fmt.Sprintf("%s/api/v4/projects/%d/languages", source.baseURL(), repo.ID)
+		var shares map[string]float64
+		err := getJSON(ctx, config, source, fmt.Sprintf("languages of [%s]", repo.PathWithNamespace), url, &shares)
+		if err != nil {
+			warnf("Failed to get languages of [%s]: %s", repo.PathWithNamespace, err)
+			continue
+		}
+		best := 0.0
+		for language, share := range shares {
+			if share > best || (share == best && language < repo.Language) {
+				repo.Language, best = language, share
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Validate checks the config for problems and returns all of them joined,
+// one per line, so they can be fixed in one pass. Durations are parsed
+// when the config is loaded; here they are only checked for sign.
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.Sources) == 0 {
+		errs = append(errs, errors.New("no Sources configured"))
+	}
+	for i, source := range c.Sources {
+		if source.destination(c) == "" {
+			errs = append(errs, fmt.Errorf("source %d has no Destination and the global Destination is empty", i+1))
+		}
+		if source.Domain == "" {
+			errs = append(errs, fmt.Errorf("source %d has no Domain or APIBaseURL", i+1))
+		}
+		if _, ok := listers[source.kind()]; !ok {
+			errs = append(errs, fmt.Errorf("source [%s] has unknown Type '%s'", source, source.Type))
+		}
+		if source.Concurrency < 0 {
+			errs = append(errs, fmt.Errorf("source [%s] Concurrency %d is negative", source, source.Concurrency))
+		}
+		for _, ref := range source.Refs {
+			if !strings.HasPrefix(ref, "refs/") {
+				errs = append(errs, fmt.Errorf("source [%s] ref '%s' does not start with refs/", source, ref))
+			}
+		}
+		errs = append(errs, validateOverrides(source)...)
+		if source.AutoGroups && source.kind() != "gitlab" {
+			errs = append(errs, fmt.Errorf("source [%s] AutoGroups requires Type gitlab", source))
+		}
+		if len(source.Refs) > 0 && !source.bare() {
+			errs = append(errs, fmt.Errorf("source [%s] Refs requires bare mirrors", source))
+		}
+		for _, ip := range source.PinnedIPs {
+			if net.ParseIP(ip) == nil {
+				errs = append(errs, fmt.Errorf("source [%s] PinnedIPs entry '%s' is not an IP address", source, ip))
+			}
+		}
+		if len(source.PinnedIPs) > 0 && c.Proxy != "" {
+			errs = append(errs, fmt.Errorf("source [%s] PinnedIPs cannot be combined with Proxy", source))
+		}
+		if len(source.PinnedIPs) > 0 && c.RateLimit > 0 {
+			errs = append(errs, fmt.Errorf("source [%s] PinnedIPs cannot be combined with RateLimit, whose proxy resolves hosts itself", source))
+		}
+		if c.needsIDs() && len(source.ListCommand) == 0 && source.kind() == "bitbucket" && (bitbucket{}).cloud(source) {
+			errs = append(errs, fmt.Errorf("source [%s] lists Bitbucket Cloud repos, which have no IDs for MaxReposPerRun and the id Layout", source))
+		}
+		if source.UpdatedSince < 0 {
+			errs = append(errs, fmt.Errorf("source [%s] UpdatedSince %s is negative", source, time.Duration(source.UpdatedSince)))
+		}
+	}
+	if err := readPatternFiles(c); err != nil {
+		errs = append(errs, err)
+	}
+	if err := compilePatterns(c); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Concurrency < 0 {
+		errs = append(errs, fmt.Errorf("Concurrency %d is negative", c.Concurrency))
+	}
+	if c.SourceConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("SourceConcurrency %d is negative", c.SourceConcurrency))
+	}
+	if c.MaxLoad < 0 {
+		errs = append(errs, fmt.Errorf("MaxLoad %g is negative", c.MaxLoad))
+	}
+	if c.PerPage < 0 {
+		errs = append(errs, fmt.Errorf("PerPage %d is negative", c.PerPage))
+	}
+	if c.WebhookAddr != "" && c.WebhookSecret == "" {
+		errs = append(errs, fmt.Errorf("WebhookAddr requires a WebhookSecret"))
+	}
+	if c.MaxFailures < 0 {
+		errs = append(errs, fmt.Errorf("MaxFailures %d is negative", c.MaxFailures))
+	}
+	for k := range c.GitConfig {
+		if !strings.Contains(k, ".") || strings.ContainsAny(k, "= ") {
+			errs = append(errs, fmt.Errorf("GitConfig key '%s' is not a git config key", k))
+		}
+	}
+	durations := []struct {
+		name string
+		d    Duration
+	}{
+		{"CloneTimeout", c.CloneTimeout},
+		{"UpdateTimeout", c.UpdateTimeout},
+		{"RetryBackoff", c.RetryBackoff},
+		{"DelayBetweenRepos", c.DelayBetweenRepos},
+		{"HealthStaleAfter", c.HealthStaleAfter},
+		{"StaleAfter", c.StaleAfter},
+		{"Interval", c.Interval},
+		{"IntervalJitter", c.IntervalJitter},
+		{"StartDelay", c.StartDelay},
+		{"GCInterval", c.GCInterval},
+		{"RunTimeout", c.RunTimeout},
+		{"SourceCooldown", c.SourceCooldown},
+		{"APITimeout", c.APITimeout},
+	}
+	for _, v := range durations {
+		if v.d < 0 {
+			errs = append(errs, fmt.Errorf("%s %s is negative", v.name, time.Duration(v.d)))
+		}
+	}
+	if c.RateLimit > 0 && c.Proxy != "" {
+		errs = append(errs, errors.New("RateLimit cannot be combined with Proxy"))
+	}
+	if c.S3 != nil && c.S3.Bucket == "" {
+		errs = append(errs, errors.New("S3 has no Bucket"))
+	}
+	if c.S3 != nil && !c.Bundle {
+		errs = append(errs, errors.New("S3 uploads bundles and requires Bundle"))
+	}
+	if c.ReportFormat != "" && c.ReportFormat != "json" {
+		errs = append(errs, fmt.Errorf("unknown report format '%s'", c.ReportFormat))
+	}
+	if err := compileLayout(c); err != nil {
+		errs = append(errs, err)
+	} else {
+		type sourceRoot struct {
+			root   string
+			source *Source
+		}
+		var roots []sourceRoot
+		for _, source := range c.Sources {
+			for _, dir := range source.destinations(c) {
+				root := filepath.Join(dir, layoutRoot(source))
+				for _, other := range roots {
+					if other.source != source && (source.Prune || other.source.Prune) && (within(root, other.root) || within(other.root, root)) {
+						errs = append(errs, fmt.Errorf("sources [%s] and [%s] share [%s], Prune needs a PathTemplate that keeps them apart", other.source, source, root))
+					}
+				}
+				roots = append(roots, sourceRoot{root, source})
+			}
+		}
+	}
+	if err := c.checkRepack(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// needsIDs reports whether the config relies on repo IDs: MaxReposPerRun
+// resumes listings by ID and the id Layout names mirrors by it.
+func (c *Config) needsIDs() bool {
+	return c.MaxReposPerRun > 0 || c.Layout == "id"
+}
+
+// missingID returns an error for the first of repos without an ID, such as
+// repos printed by a ListCommand that omits id.
+func missingID(repos []*Repo) error {
+	for _, repo := range repos {
+		if repo.ID == 0 {
+			return fmt.Errorf("repo '%s' has no id, which MaxReposPerRun and the id Layout need", repo.PathWithNamespace)
+		}
+	}
+	return nil
+}
+
+// within reports whether path is dir or below it.
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// runVerify checks every local mirror of every source without any network
+// access: it must be a valid repository of its own and pass git fsck. It
+// prints the corrupt mirrors and a summary and returns ExitFailed if any
+// mirror is corrupt.
+func runVerify(config *Config) int {
+	code := ExitOK
+	seen := map[string]bool{}
+	var mirrors []string
+	for _, source := range config.Sources {
+		found, err := localMirrors(config, source)
+		if err != nil {
+			warnf("Failed to walk mirrors of source [%s]: %s", source, err)
+			code = ExitFailed
+			continue
+		}
+		for _, local := range found {
+			if !seen[local] {
+				seen[local] = true
+				mirrors = append(mirrors, local)
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var corrupt []string
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, config.concurrency())
+	for _, local := range mirrors {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(local string) {
+			defer func() { <-sem; wg.Done() }()
+			reason := ""
+			if !valid(local) {
+				reason = "not a git repository"
+			} else if _, err := fsck(local, nil); err != nil {
+				reason = fmt.Sprintf("fsck error:'%s'", err)
+			}
+			if reason == "" {
+				debugf("Verified [%s]", local)
+				return
+			}
+			warnf("Corrupt mirror [%s]: %s", local, reason)
+			mu.Lock()
+			corrupt = append(corrupt, local)
+			mu.Unlock()
+		}(local)
+	}
+	wg.Wait()
+
+	sort.Strings(corrupt)
+	fmt.Printf("%d mirrors, %d healthy, %d corrupt\n", len(mirrors), len(mirrors)-len(corrupt), len(corrupt))
+	for _, local := range corrupt {
+		fmt.Printf("  corrupt %s\n", local)
+	}
+	if len(corrupt) > 0 {
+		code = ExitFailed
+	}
+	return code
+}
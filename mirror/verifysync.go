@@ -0,0 +1,187 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// syncResult is how far a local mirror lags its remote: refs whose tip
+// differs, refs missing locally and local refs gone from the remote.
+type syncResult struct {
+	local                  string
+	differ, missing, stale int
+	err                    error
+}
+
+func (r *syncResult) drifted() bool {
+	return r.differ+r.missing+r.stale > 0
+}
+
+// runVerifySync compares the branch and tag tips of every selected repo's
+// mirror with the remote's, listed with ls-remote, without fetching any
+// objects. It prints the drifted mirrors per source and returns ExitFailed
+// if any mirror lags its remote, is missing or could not be compared.
+func runVerifySync(config *Config) int {
+	code := ExitOK
+	for _, source := range config.Sources {
+		repos, _, err := getRepo(context.Background(), config, source)
+		if err != nil {
+			warnf("Failed to get source [%s] repos. error:'%s'", source, err)
+			code = ExitFailed
+			continue
+		}
+		var mu sync.Mutex
+		var results []*syncResult
+		var missing []string
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, config.concurrency())
+		for _, repo := range repos {
+			if skip(source, repo) {
+				continue
+			}
+			local := localPath(config, source, repo)
+			if _, err := os.Stat(local); os.IsNotExist(err) {
+				missing = append(missing, local)
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(repo *Repo, local string) {
+				defer func() { <-sem; wg.Done() }()
+				r := compareTips(config, source, source.remote(repo), local)
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}(repo, local)
+		}
+		wg.Wait()
+
+		sort.Slice(results, func(i, j int) bool { return results[i].local < results[j].local })
+		sort.Strings(missing)
+		insync, drifted, failed := 0, 0, 0
+		for _, r := range results {
+			switch {
+			case r.err != nil:
+				failed++
+			case r.drifted():
+				drifted++
+			default:
+				insync++
+			}
+		}
+		fmt.Printf("Source [%s]: %d mirrors checked, %d in sync, %d drifted, %d failed, %d not mirrored\n", source, len(results), insync, drifted, failed, len(missing))
+		for _, r := range results {
+			if r.err != nil {
+				fmt.Printf("  failed  %s: %s\n", r.local, r.err)
+			} else if r.drifted() {
+				fmt.Printf("  drifted %s: %d refs differ, %d missing, %d stale\n", r.local, r.differ, r.missing, r.stale)
+			}
+		}
+		for _, local := range missing {
+			fmt.Printf("  missing %s\n", local)
+		}
+		if drifted+failed+len(missing) > 0 {
+			code = ExitFailed
+		}
+	}
+	return code
+}
+
+// compareTips lists the branches and tags of remote and of the mirror at
+// local and counts the differences. Checkouts keep the remote branches as
+// refs/remotes/origin/*, and only the refs selected by Refs are compared.
+// Local refs gone from the remote only count as stale when PruneRefs would
+// have removed them.
+func compareTips(config *Config, source *Source, remote, local string) *syncResult {
+	r := &syncResult{local: local}
+	ctx, cancel := context.WithTimeout(context.Background(), config.apiTimeout())
+	defer cancel()
+	cmd, err := gitCommand(ctx, append(auth(source, remote), "ls-remote", "--heads", "--tags", "--refs", remote)...)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err = execute(cmd, nil)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	upstream := parseTips(stdout.Bytes())
+
+	args := []string{"-C", local, "for-each-ref", "--format=%(objectname) %(refname)", "refs/tags"}
+	if source.bare() {
+		args = append(args, "refs/heads")
+	} else {
+		args = append(args, "refs/remotes/origin")
+	}
+	out, err := gitOutput(nil, args...)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	mirrored := map[string]string{}
+	for ref, tip := range parseTips(out) {
+		if branch, ok := strings.CutPrefix(ref, "refs/remotes/origin/"); ok {
+			if branch == "HEAD" {
+				continue
+			}
+			ref = "refs/heads/" + branch
+		}
+		mirrored[ref] = tip
+	}
+
+	for ref, tip := range upstream {
+		if !selected(source, ref) {
+			continue
+		}
+		switch have, ok := mirrored[ref]; {
+		case !ok:
+			r.missing++
+		case have != tip:
+			r.differ++
+		}
+	}
+	for ref := range mirrored {
+		if _, ok := upstream[ref]; !ok && source.pruneRefs(config) && selected(source, ref) {
+			r.stale++
+		}
+	}
+	return r
+}
+
+// parseTips parses "<object> <ref>" lines, as printed by ls-remote and
+// for-each-ref, into a map of ref to object.
+func parseTips(b []byte) map[string]string {
+	tips := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			tips[fields[1]] = fields[0]
+		}
+	}
+	return tips
+}
+
+// selected reports whether ref is mirrored for source, that is Refs is
+// empty or ref matches one of its refs or ref globs.
+func selected(source *Source, ref string) bool {
+	if len(source.Refs) == 0 || !source.bare() {
+		return true
+	}
+	for _, pattern := range source.Refs {
+		prefix, suffix, glob := strings.Cut(pattern, "*")
+		if ref == pattern || glob && len(ref) >= len(prefix)+len(suffix) && strings.HasPrefix(ref, prefix) && strings.HasSuffix(ref, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package mirror
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// version, commit and date describe the build, set at build time with
+// -ldflags "-X $pkg.version=v1.2.3 -X $pkg.commit=<sha> -X $pkg.date=<time>"
+// where $pkg is github.com/chamzzzzzz/gitlab-repo-mirror/mirror.
+// Without them the module version and the VCS revision and time from the
+// build info are used.
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// appVersion returns version, or the best version the build info gives.
+func appVersion() string {
+	if version != "" {
+		return version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return "dev-" + s.Value[:12]
+		}
+	}
+	return "dev"
+}
+
+// buildCommit returns commit, or the VCS revision from the build info with
+// a -dirty suffix for builds of modified trees.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	rev := buildSetting("vcs.revision")
+	if rev != "" && buildSetting("vcs.modified") == "true" {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// buildDate returns date, or the VCS commit time from the build info.
+func buildDate() string {
+	if date != "" {
+		return date
+	}
+	return buildSetting("vcs.time")
+}
+
+func buildSetting(key string) string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, s := range bi.Settings {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// printVersion prints the version, commit, build date and Go version.
+func printVersion() {
+	fmt.Printf("gitlab-repo-mirror %s\n", appVersion())
+	if c := buildCommit(); c != "" {
+		fmt.Printf("commit: %s\n", c)
+	}
+	if d := buildDate(); d != "" {
+		fmt.Printf("built:  %s\n", d)
+	}
+	fmt.Printf("go:     %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// userAgent is the User-Agent of every API request, Config.UserAgent or
+// gitlab-repo-mirror/<version> git/<git version>, built on first use.
+var userAgent = sync.OnceValue(func() string {
+	if apiUserAgent != "" {
+		return apiUserAgent
+	}
+	ua := "gitlab-repo-mirror/" + appVersion()
+	if out, err := gitOutput(nil, "version"); err == nil {
+		ua += " git/" + strings.TrimSpace(strings.TrimPrefix(string(out), "git version "))
+	}
+	return ua
+})
@@ -0,0 +1,123 @@
+package mirror
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// webhookQueue is how many webhook triggered repos may wait to be mirrored
+// before further hooks are rejected with 503.
+const webhookQueue = 100
+
+// webhook receives GitLab push hooks on /webhook and mirrors or updates the
+// pushed repo right away, between the scheduled runs. The repos are
+// processed through the same global slots as the runs.
+type webhook struct {
+	config  *Config
+	queue   chan string
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+type pushHook struct {
+	ObjectKind string `json:"object_kind"`
+	Project    struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+}
+
+// serveWebhook starts Config.Concurrency workers for the queued repos and
+// serves the webhook endpoint on addr.
+func serveWebhook(ctx context.Context, config *Config, addr string) error {
+	wh := &webhook{
+		config:  config,
+		queue:   make(chan string, webhookQueue),
+		pending: map[string]bool{},
+	}
+	for i := 0; i < config.concurrency(); i++ {
+		go wh.work(ctx)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", wh)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (wh *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(wh.config.WebhookSecret)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var hook pushHook
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hook)
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	if hook.ObjectKind != "push" && hook.ObjectKind != "tag_push" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	target := hook.Project.WebURL
+	if target == "" {
+		target = hook.Project.PathWithNamespace
+	}
+	if target == "" {
+		http.Error(w, "payload has no project", http.StatusBadRequest)
+		return
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.pending[target] {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	select {
+	case wh.queue <- target:
+		wh.pending[target] = true
+		debugf("Queued [%s] from webhook", target)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "queue full", http.StatusServiceUnavailable)
+	}
+}
+
+// work mirrors the queued repos until ctx is done. A repo pushed again
+// while queued is only mirrored once.
+func (wh *webhook) work(ctx context.Context) {
+	for {
+		var target string
+		select {
+		case <-ctx.Done():
+			return
+		case target = <-wh.queue:
+		}
+		wh.mu.Lock()
+		delete(wh.pending, target)
+		wh.mu.Unlock()
+		source, repo, err := findRepo(ctx, wh.config, target)
+		if err != nil {
+			warnf("Failed to find webhook repo [%s]: %s", target, err)
+			continue
+		}
+		mirrorRepo(ctx, wh.config, snapshot(source), repo)
+	}
+}
+
+// snapshot returns a copy of source, taken under sourcesMu, for a webhook
+// repo to be processed with while a run may change the source.
+func snapshot(source *Source) *Source {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	s := *source
+	s.base = source.origin()
+	return &s
+}
@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// wikiPath returns where the wiki of the mirror at local is kept.
+func wikiPath(local string) string {
+	return strings.TrimSuffix(local, ".git") + ".wiki.git"
+}
+
+// wikiRemote returns the clone URL of the wiki of the repo at remote.
+func wikiRemote(remote string) string {
+	return strings.TrimSuffix(remote, ".git") + ".wiki.git"
+}
+
+// notFound reports whether git failed because the remote repository does
+// not exist, which is what a wiki without pages looks like.
+func notFound(err error) bool {
+	var e *gitError
+	return errors.As(err, &e) && (strings.Contains(e.stderr, "not found") || strings.Contains(e.stderr, "returned error: 404"))
+}
+
+// mirrorWiki clones or updates the wiki of repo next to its mirror at local.
+// An empty wiki is skipped; failures are counted as FailedWiki and do not
+// affect the repo itself.
+func mirrorWiki(ctx context.Context, config *Config, source *Source, stat *Stat, repo *Repo, remote, local string, w io.Writer) {
+	if !repo.WikiEnabled {
+		return
+	}
+	remote, local = wikiRemote(remote), wikiPath(local)
+	if _, err := os.Stat(local); err == nil && valid(local) {
+		err = retry(ctx, config, fmt.Sprintf("update [%s]", remote), network, func() error {
+			uctx, cancel := context.WithTimeout(ctx, config.updateTimeout())
+			defer cancel()
+			_, err := update(uctx, local, auth(source, remote), w)
+			return err
+		})
+		if err != nil {
+			stat.failf("Failed update wiki [%s] -> [%s]: %s", remote, local, err)
+			stat.FailedWiki++
+			return
+		}
+		stat.Wikis++
+		return
+	}
+	remove(local)
+	tmp := tempPath(local)
+	err := retry(ctx, config, fmt.Sprintf("clone [%s]", remote), network, func() error {
+		cctx, cancel := context.WithTimeout(ctx, config.cloneTimeout())
+		defer cancel()
+		_, err := clone(cctx, remote, tmp, true, 0, "", nil, auth(source, remote), w)
+		if err != nil {
+			remove(tmp)
+		}
+		return err
+	})
+	if err != nil {
+		cleanup(tmp)
+		if notFound(err) {
+			return
+		}
+		stat.failf("Failed mirror wiki [%s] -> [%s]: %s", remote, local, err)
+		stat.FailedWiki++
+		return
+	}
+	_, err = disablegc(tmp, w)
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		stat.failf("Failed mirror wiki [%s] -> [%s]: %s", remote, local, err)
+		cleanup(tmp)
+		stat.FailedWiki++
+		return
+	}
+	stat.Wikis++
+}